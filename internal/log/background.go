@@ -0,0 +1,47 @@
+package log
+
+import (
+	"sync"
+	"time"
+)
+
+// background
+// runs the goroutines owned by a log, they are all stopped before the log is closed.
+type background struct {
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newBackground() *background {
+	return &background{done: make(chan struct{})}
+}
+
+// run calls fn every interval, and whenever trigger fires, until the background is stopped.
+// A zero interval or a nil trigger never fire.
+func (b *background) run(interval time.Duration, trigger <-chan struct{}, fn func()) {
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		var tick <-chan time.Time
+		if interval > 0 {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for {
+			select {
+			case <-b.done:
+				return
+			case <-tick:
+			case <-trigger:
+			}
+			fn()
+		}
+	}()
+}
+
+// stop signals the goroutines to return and waits for them.
+func (b *background) stop() {
+	close(b.done)
+	b.wg.Wait()
+}
@@ -0,0 +1,112 @@
+package log
+
+import (
+	"errors"
+	api "github.com/adityavit/dslog/api/v1"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// Stores of formatVersion write their records in blocks, each framed and checksummed like a single record was
+// before. A batch, or the appends committed together as a group, make up one block, so a crash never leaves
+// part of one behind, and the block is compressed as a whole. A block is the codec it is compressed with and
+// the number of records in it, followed by the records each prefixed by its length as a varint.
+const blockHeaderWidth = 5 // codec 1, records 4
+
+// maxBlockBytes is about how many bytes of records copied into a new segment go into a block, see appendAt.
+const maxBlockBytes = 16 << 10
+
+var errBadBlock = errors.New("bad block")
+
+// encodeBlock
+// marshals the records into a block compressed with codec. The records are left uncompressed if compressing
+// doesn't make them smaller, as for small blocks.
+func encodeBlock(records []*api.Record, codec Codec) ([]byte, error) {
+	var data []byte
+	// the size was just worked out for the length
+	opts := proto.MarshalOptions{UseCachedSize: true}
+	for _, r := range records {
+		var err error
+		data = protowire.AppendVarint(data, uint64(proto.Size(r)))
+		if data, err = opts.MarshalAppend(data, r); err != nil {
+			return nil, err
+		}
+	}
+	if codec != CodecNone {
+		compressed, err := codec.compress(data)
+		if err != nil {
+			return nil, err
+		}
+		if len(compressed) < len(data) {
+			data = compressed
+		} else {
+			codec = CodecNone
+		}
+	}
+	b := make([]byte, blockHeaderWidth, blockHeaderWidth+len(data))
+	b[0] = byte(codec)
+	enc.PutUint32(b[1:blockHeaderWidth], uint32(len(records)))
+	return append(b, data...), nil
+}
+
+// blockSize returns at most how many bytes the records take up in a block, uncompressed.
+func blockSize(r *api.Record) uint64 {
+	n := proto.Size(r)
+	return uint64(protowire.SizeVarint(uint64(n)) + n)
+}
+
+// decodedBlock
+// is where the records of a block are. data holds the records decompressed, or the uncompressed block itself
+// once it is kept, otherwise they are in the block read.
+type decodedBlock struct {
+	pos   uint64 // of the block in the store
+	data  []byte
+	spans [][2]int // start and end of every record
+}
+
+// decodeBlock finds the records of the block b read from pos, errBadBlock is returned if it doesn't hold them.
+func decodeBlock(b []byte, pos uint64) (*decodedBlock, error) {
+	if len(b) < blockHeaderWidth {
+		return nil, errBadBlock
+	}
+	codec, n := Codec(b[0]), enc.Uint32(b[1:blockHeaderWidth])
+	d := &decodedBlock{pos: pos}
+	data := b[blockHeaderWidth:]
+	if codec != CodecNone {
+		if codec > CodecZlib {
+			return nil, errBadBlock
+		}
+		var err error
+		if data, err = codec.decompress(data); err != nil {
+			return nil, errBadBlock
+		}
+		d.data = data
+	}
+	start := len(b) - len(data)
+	if d.data != nil {
+		start = 0
+	}
+	for rest := data; len(rest) > 0; {
+		size, w := protowire.ConsumeVarint(rest)
+		if w < 0 || size > uint64(len(rest)-w) {
+			return nil, errBadBlock
+		}
+		start += w
+		d.spans = append(d.spans, [2]int{start, start + int(size)})
+		start += int(size)
+		rest = rest[w+int(size):]
+	}
+	if n == 0 || uint32(len(d.spans)) != n {
+		return nil, errBadBlock
+	}
+	return d, nil
+}
+
+// record returns the marshaled record k of the block b it was decoded from.
+func (d *decodedBlock) record(b []byte, k int) []byte {
+	if d.data != nil {
+		b = d.data
+	}
+	s := d.spans[k]
+	return b[s[0]:s[1]:s[1]]
+}
@@ -0,0 +1,51 @@
+package log
+
+import (
+	"bytes"
+	api "github.com/adityavit/dslog/api/v1"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"testing"
+)
+
+func TestBlock(t *testing.T) {
+	value := bytes.Repeat([]byte("hello world "), 10)
+	records := []*api.Record{{Value: value, Offset: 4}, {Value: value, Offset: 5}, {Offset: 7}}
+	for _, codec := range []Codec{CodecNone, CodecGzip, CodecFlate, CodecZlib} {
+		b, err := encodeBlock(records, codec)
+		assert.NoError(t, err, "error encoding block")
+		assert.Equal(t, codec, Codec(b[0]), "block isn't compressed")
+		d, err := decodeBlock(b, 32)
+		assert.NoError(t, err, "error decoding block")
+		assert.Equal(t, uint64(32), d.pos, "block at the wrong position")
+		assert.Len(t, d.spans, len(records), "unexpected records in block")
+		for k, want := range records {
+			r := &api.Record{}
+			assert.NoError(t, proto.Unmarshal(d.record(b, k), r), "error unmarshaling record")
+			assert.Equal(t, want.Offset, r.Offset, "unexpected record read")
+			assert.Equal(t, want.Value, r.Value, "unexpected record read")
+		}
+	}
+
+	// a record which doesn't compress is stored as it is
+	b, err := encodeBlock(records[2:], CodecGzip)
+	assert.NoError(t, err, "error encoding block")
+	assert.Equal(t, CodecNone, Codec(b[0]), "compressing makes the block bigger")
+	d, err := decodeBlock(b, 32)
+	assert.NoError(t, err, "error decoding block")
+	assert.Nil(t, d.data, "uncompressed block is copied")
+
+	b, err = encodeBlock(records, CodecNone)
+	assert.NoError(t, err, "error encoding block")
+	for name, bad := range map[string][]byte{
+		"header":      b[:blockHeaderWidth-1],
+		"torn":        b[:len(b)-1],
+		"empty":       b[:blockHeaderWidth],
+		"count":       append([]byte{byte(CodecNone), 0, 0, 0, 9}, b[blockHeaderWidth:]...),
+		"codec":       append([]byte{byte(CodecZlib + 1)}, b[1:]...),
+		"compression": append([]byte{byte(CodecGzip)}, b[1:]...),
+	} {
+		_, err = decodeBlock(bad, 32)
+		assert.Equal(t, errBadBlock, err, "bad block %s is decoded", name)
+	}
+}
@@ -0,0 +1,91 @@
+package log
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// segmentCache
+// bounds how many closed segments have their files open, closing the least recently used ones once there
+// are more than max. Segments somebody holds a reference to aren't closed, so max is exceeded while more
+// are being read at once. The active segment is never in the cache, its files stay open.
+type segmentCache struct {
+	max   int // 0 keeps every segment open once it is opened
+	clock atomic.Uint64
+	mu    sync.Mutex
+	open  map[*segment]bool // closed segments with their files open
+}
+
+func newSegmentCache(max int) *segmentCache {
+	return &segmentCache{
+		max:  max,
+		open: make(map[*segment]bool),
+	}
+}
+
+// add puts a closed segment whose files are open into the cache, closing others if there are too many open.
+func (c *segmentCache) add(s *segment) {
+	if c == nil {
+		return
+	}
+	s.used.Store(c.clock.Add(1))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s.evictable = true
+	c.open[s] = true
+	c.evict()
+}
+
+// touch marks the segment as just used, one whose files were reopened is put back into the cache.
+func (c *segmentCache) touch(s *segment, reopened bool) {
+	if c == nil {
+		return
+	}
+	s.used.Store(c.clock.Add(1))
+	if !reopened {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// the segment may have become the active one again since it was reopened
+	if !s.evictable {
+		return
+	}
+	c.open[s] = true
+	c.evict()
+}
+
+// remove takes the segment out of the cache, its files are left open.
+func (c *segmentCache) remove(s *segment) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s.evictable = false
+	delete(c.open, s)
+}
+
+// evict closes the least recently used segments which aren't being read until at most max are open.
+func (c *segmentCache) evict() {
+	if c.max <= 0 {
+		return
+	}
+	var busy map[*segment]bool
+	for len(c.open)-len(busy) > c.max {
+		var lru *segment
+		for s := range c.open {
+			if !busy[s] && (lru == nil || s.used.Load() < lru.used.Load()) {
+				lru = s
+			}
+		}
+		if !lru.closeIdle() {
+			if busy == nil {
+				busy = make(map[*segment]bool)
+			}
+			busy[lru] = true
+			continue
+		}
+		delete(c.open, lru)
+	}
+}
@@ -0,0 +1,155 @@
+package log
+
+import (
+	api "github.com/adityavit/dslog/api/v1"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestSegmentCache(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxOpenSegments = 1
+	l := newRetentionLog(t, c)
+	assert.LessOrEqual(t, len(l.cache.open), 1, "too many closed segments are open")
+	assert.NoError(t, l.Close(), "error closing log")
+
+	// closed segments are opened once they are read
+	l, err := newLog(l.Dir, l.Config)
+	assert.NoError(t, err, "error reopening log")
+	defer l.Close()
+	for _, seg := range l.segments[:3] {
+		assert.Nil(t, seg.store, "closed segment is opened before it is read")
+	}
+	for off := uint64(0); off < 7; off++ {
+		r, err := l.Read(off)
+		assert.NoError(t, err, "error reading record")
+		assert.Equal(t, off, r.Offset, "unexpected record read")
+		assert.LessOrEqual(t, len(l.cache.open), 1, "too many closed segments are open")
+	}
+	assert.Nil(t, l.segments[0].store, "least recently read segment is still open")
+	assert.NotNil(t, l.segments[2].store, "most recently read segment is closed")
+
+	// a segment whose files are gone can't be read
+	name := segmentFile(l.Dir, 0, storeExt)
+	assert.NoError(t, os.Rename(name, name+".bak"))
+	_, err = l.Read(5)
+	assert.NoError(t, err, "error reading record")
+	_, err = l.Read(0)
+	assert.True(t, os.IsNotExist(err), "missing segment file is read")
+	assert.NoError(t, os.Rename(name+".bak", name))
+
+	// a segment being read isn't closed
+	_, release, err := l.ReadRaw(0)
+	assert.NoError(t, err, "error reading raw record")
+	_, err = l.Read(3)
+	assert.NoError(t, err, "error reading record")
+	assert.NotNil(t, l.segments[0].store, "segment being read is closed")
+	release()
+	_, err = l.Read(5)
+	assert.NoError(t, err, "error reading record")
+	assert.Nil(t, l.segments[0].store, "released segment is still open")
+
+	// segments are closed and reopened under concurrent readers
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				off := uint64(i+j) % 7
+				r, err := l.Read(off)
+				assert.NoError(t, err, "error reading record")
+				assert.Equal(t, off, r.Offset, "unexpected record read")
+			}
+		}(i)
+	}
+	for i := 0; i < 20; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		assert.NoError(t, err, "error appending record")
+	}
+	wg.Wait()
+}
+
+func TestSegmentCacheDropped(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxOpenSegments = 1
+	l := newRetentionLog(t, c)
+	seg := l.segments[0]
+	assert.NoError(t, seg.open(), "error opening segment")
+	b, release, err := l.ReadRaw(1)
+	assert.NoError(t, err, "error reading raw record")
+
+	// the segment the log drops is closed by its last reader, not by the cache
+	assert.NoError(t, l.Truncate(1), "error truncating log")
+	for off := uint64(2); off < 7; off++ {
+		_, err := l.Read(off)
+		assert.NoError(t, err, "error reading record")
+	}
+	assert.False(t, l.cache.open[seg], "dropped segment is cached")
+	r, err := seg.readPublished(0)
+	assert.NoError(t, err, "error reading dropped segment")
+	assert.Equal(t, uint64(0), r.Offset, "unexpected record read")
+	rec := &api.Record{}
+	assert.NoError(t, proto.Unmarshal(b, rec), "raw record changed before release")
+	assert.Equal(t, uint64(1), rec.Offset, "raw record changed before release")
+	release()
+	assert.NoError(t, seg.release(), "error releasing segment")
+	assert.Equal(t, int32(0), seg.refs.Load(), "dropped segment is still held")
+
+	// readers looking the segment up after it was dropped don't open whatever is at its path
+	seg = l.segments[0]
+	_, err = l.Read(6)
+	assert.NoError(t, err, "error reading record")
+	assert.Nil(t, seg.store, "least recently read segment is still open")
+	assert.True(t, seg.acquire(), "error acquiring segment")
+	assert.NoError(t, l.Truncate(3), "error truncating log")
+	assert.Equal(t, errSegmentClosed, seg.reopen(), "dropped segment is opened")
+	assert.NoError(t, seg.release(), "error releasing segment")
+}
+
+func TestSegmentCacheSealed(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxOpenSegments = 1
+	l := newRetentionLog(t, c)
+	assert.NoError(t, l.Close(), "error closing log")
+	l, err := newLog(l.Dir, l.Config)
+	assert.NoError(t, err, "error reopening log")
+	defer l.Close()
+
+	// closed segments are opened as they were sealed, the index isn't grown
+	_, err = l.Read(0)
+	assert.NoError(t, err, "error reading record")
+	seg := l.segments[0]
+	assert.False(t, seg.index.writable, "index of a closed segment is writable")
+	fi, err := os.Stat(seg.index.Name())
+	assert.NoError(t, err, "error reading index")
+	assert.Equal(t, int64(seg.index.start+seg.index.size.Load()), fi.Size(), "index of a closed segment is grown")
+	_, err = seg.store.File.Write([]byte("hello world"))
+	assert.Error(t, err, "store of a closed segment is writable")
+
+	// a store torn after it was sealed isn't repaired, it is reported
+	name := segmentFile(l.Dir, 2, storeExt)
+	fi, err = os.Stat(name)
+	assert.NoError(t, err, "error reading store")
+	assert.NoError(t, os.Truncate(name, fi.Size()-1))
+	_, err = l.Read(2)
+	assert.ErrorIs(t, err, ErrCorrupt, "torn store of a closed segment is read")
+	after, err := os.Stat(name)
+	assert.NoError(t, err, "error reading store")
+	assert.Equal(t, fi.Size()-1, after.Size(), "store of a closed segment is repaired")
+	assert.Nil(t, l.segments[1].store, "files of a corrupt segment are left open")
+	_, err = l.Read(4)
+	assert.NoError(t, err, "error reading record")
+
+	// a segment opened read-only takes appends again once it is truncated into
+	assert.NoError(t, l.TruncateAfter(4), "error truncating log")
+	off, err := l.Append(&api.Record{Value: []byte("hello world")})
+	assert.NoError(t, err, "error appending record")
+	assert.Equal(t, uint64(5), off, "unexpected offset appended")
+	r, err := l.Read(5)
+	assert.NoError(t, err, "error reading record")
+	assert.Equal(t, uint64(5), r.Offset, "unexpected record read")
+}
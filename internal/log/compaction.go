@@ -0,0 +1,189 @@
+package log
+
+import (
+	api "github.com/adityavit/dslog/api/v1"
+	"os"
+	"path"
+	"time"
+)
+
+// cleanerDir is the directory in the log directory compacted segments are written to before they are swapped in.
+const cleanerDir = "cleaner"
+
+// Compact
+// rewrites the closed segments keeping only the latest record of every key, records without a key are always kept.
+// Tombstones are kept for the delete retention, and after that dropped along with the key. Held segments aren't rewritten.
+// The records kept keep their offsets, reading an offset compacted away gets the next record kept instead.
+// The last record of a segment is always kept so the segment keeps covering the same offsets.
+func (l *Log) Compact() error {
+	return l.compact(time.Now())
+}
+
+func (l *Log) compact(now time.Time) error {
+	l.maintMu.Lock()
+	defer l.maintMu.Unlock()
+	l.mu.RLock()
+	var closed []*segment
+	for _, seg := range l.segments {
+		if seg != l.activeSegment {
+			closed = append(closed, seg)
+		}
+	}
+	l.mu.RUnlock()
+	// Closed segments don't change and only maintenance tasks remove them, so they are read without the lock.
+	c := &cleaner{
+		latest:          make(map[string]uint64),
+		pinned:          make(map[string]bool),
+		deleteRetention: now.Add(-l.Config.Compaction.DeleteRetention).UnixNano(),
+	}
+	// records kept whether they are superseded or not
+	var kept []*api.Record
+	for _, seg := range closed {
+		err := seg.each(func(r *api.Record) error {
+			if len(r.Key) > 0 {
+				c.latest[string(r.Key)] = r.Offset
+			}
+			if r.Offset == seg.nextOffset-1 || l.held(seg) {
+				kept = append(kept, r)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, r := range kept {
+		if len(r.Key) > 0 && c.latest[string(r.Key)] != r.Offset {
+			c.pinned[string(r.Key)] = true
+		}
+	}
+	for _, seg := range closed {
+		if l.held(seg) {
+			continue
+		}
+		if err := l.compactSegment(seg, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleaner decides which records compaction keeps.
+type cleaner struct {
+	latest map[string]uint64 // offset of the latest record of every key
+	// pinned are the keys which have a superseded record kept as the last one of its segment or in a held segment,
+	// their tombstones are kept so the key stays deleted
+	pinned          map[string]bool
+	deleteRetention int64 // tombstones appended before are dropped
+}
+
+// keep reports if the record of seg is kept.
+func (c *cleaner) keep(seg *segment, r *api.Record) bool {
+	if len(r.Key) == 0 || r.Offset == seg.nextOffset-1 {
+		return true
+	}
+	if c.latest[string(r.Key)] != r.Offset {
+		return false
+	}
+	return !r.Tombstone || r.AppendTime >= c.deleteRetention || c.pinned[string(r.Key)]
+}
+
+// compactSegment
+// writes the records of seg to keep into a new segment in the cleaner directory and swaps it in for seg.
+// Nothing is swapped if every record is kept.
+func (l *Log) compactSegment(seg *segment, c *cleaner) error {
+	dir := path.Join(l.Dir, cleanerDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	cleaned, err := newSegment(dir, seg.baseOffset, l.Config)
+	if err != nil {
+		return err
+	}
+	dropped := 0
+	err = seg.each(func(r *api.Record) error {
+		if !c.keep(seg, r) {
+			dropped++
+			return nil
+		}
+		return cleaned.appendAt(r)
+	})
+	if err == nil {
+		// Close syncs the store, it has to be on disk before it replaces the old one
+		err = cleaned.Close()
+	}
+	if err != nil || dropped == 0 {
+		removeSegmentFiles(dir, seg.baseOffset)
+		return err
+	}
+	return l.swapSegment(seg, dir)
+}
+
+// swapSegment
+// replaces seg with the segment of the same base offset written to dir.
+// Renaming the store is the commit point, after a crash an index left from the old segment is rebuilt on open.
+// Readers still holding seg keep reading its replaced files until they release it.
+func (l *Log) swapSegment(seg *segment, dir string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	unpin, err := pinSegments([]*segment{seg})
+	if err != nil {
+		return err
+	}
+	defer unpin()
+	// until the swap is done the segment is opened and repaired after a crash, not trusted to be as recorded
+	m := l.manifest()
+	for i := range m.Segments {
+		if m.Segments[i].BaseOffset == seg.baseOffset {
+			m.Segments[i].Size, m.Segments[i].MaxTime = 0, 0
+		}
+	}
+	if err = writeManifest(l.Dir, m); err != nil {
+		return err
+	}
+	for _, ext := range []string{storeExt, indexExt, timeIndexExt} {
+		if err := os.Rename(segmentFile(dir, seg.baseOffset, ext), segmentFile(l.Dir, seg.baseOffset, ext)); err != nil {
+			return err
+		}
+	}
+	if err := syncDir(l.Dir); err != nil {
+		return err
+	}
+	s, err := l.loadSegment(seg.baseOffset)
+	if err != nil {
+		return err
+	}
+	if err = s.seal(); err != nil {
+		return err
+	}
+	for i := range l.segments {
+		if l.segments[i] == seg {
+			l.segments[i] = s
+		}
+	}
+	l.publishSegments()
+	if err = seg.drop(); err != nil {
+		return err
+	}
+	// the manifest records the size of the compacted segment
+	return l.writeManifest()
+}
+
+// each calls fn with the records of the segment in order.
+func (s *segment) each(fn func(*api.Record) error) error {
+	if err := s.open(); err != nil {
+		return err
+	}
+	defer s.release()
+	for off := s.baseOffset; off < s.nextOffset; off++ {
+		r, err := s.Read(off)
+		if err != nil {
+			return err
+		}
+		if err = fn(r); err != nil {
+			return err
+		}
+		off = r.Offset
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package log
+
+import (
+	api "github.com/adityavit/dslog/api/v1"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// newCompactionLog returns a log with three records per segment holding the records.
+func newCompactionLog(t *testing.T, records ...*api.Record) *Log {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "compaction_test")
+	assert.NoError(t, err, "error creating dir")
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	c.Segment.TimeIndexInterval = 1
+	l, err := newLog(dir, c)
+	assert.NoError(t, err, "error creating log")
+	t.Cleanup(func() { l.Close() })
+	for _, r := range records {
+		_, err := l.Append(r)
+		assert.NoError(t, err, "error appending record")
+	}
+	return l
+}
+
+// keyed returns records with the keys, and their offsets as values.
+func keyed(keys ...string) []*api.Record {
+	var records []*api.Record
+	for i, key := range keys {
+		records = append(records, &api.Record{Key: []byte(key), Value: []byte{byte(i)}})
+	}
+	return records
+}
+
+func TestCompact(t *testing.T) {
+	// segments 0-2, 3-5 are closed, 6 is in the active segment
+	l := newCompactionLog(t, keyed("a", "b", "a", "", "a", "b", "a")...)
+	size := l.segments[0].store.size
+	first := timeOf(t, l, 0)
+	assert.NoError(t, l.Compact(), "error compacting log")
+	assert.Less(t, l.segments[0].store.size, size, "store isn't compacted")
+
+	// 0 and 1 are superseded by 2 and 5, 2 would be superseded by 4 but is the last record of its segment,
+	// 4 is only superseded by 6 in the active segment, which compaction doesn't look at
+	want := map[uint64]uint64{0: 2, 1: 2, 2: 2, 3: 3, 4: 4, 5: 5, 6: 6}
+	check := func() {
+		for off, next := range want {
+			r, err := l.Read(off)
+			assert.NoError(t, err, "error reading record")
+			assert.Equal(t, next, r.Offset, "unexpected record read")
+			assert.Equal(t, []byte{byte(next)}, r.Value, "unexpected value read")
+		}
+		hOffset, err := l.HighestOffset()
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(6), hOffset, "compaction changes the highest offset")
+	}
+	check()
+	off, err := l.OffsetForTime(first)
+	assert.NoError(t, err, "error looking up time")
+	assert.Equal(t, uint64(2), off, "time lookup returns compacted offset")
+
+	// compacting again changes nothing
+	assert.NoError(t, l.Compact(), "error compacting log")
+	check()
+
+	assert.NoError(t, l.Close(), "error closing log")
+	l, err = newLog(l.Dir, l.Config)
+	assert.NoError(t, err, "error reopening log")
+	defer l.Close()
+	assert.Empty(t, l.Recovered(), "compacted segments are repaired")
+	check()
+}
+
+func TestCompactSwapCrash(t *testing.T) {
+	l := newCompactionLog(t, keyed("a", "b", "a", "", "a", "b", "a")...)
+	name := l.segments[0].index.Name()
+	assert.NoError(t, l.segments[0].index.file.Sync())
+	index, err := os.ReadFile(name)
+	assert.NoError(t, err, "error reading index")
+	assert.NoError(t, l.Compact(), "error compacting log")
+	assert.NoError(t, l.Close(), "error closing log")
+
+	// crashed after the store was renamed, and halfway through writing the next segments
+	assert.NoError(t, os.WriteFile(name, index, 0644))
+	m, err := ReadManifest(l.Dir)
+	assert.NoError(t, err, "error reading manifest")
+	m.Segments[0].Size, m.Segments[0].MaxTime = 0, 0
+	assert.NoError(t, writeManifest(l.Dir, m))
+	cleaned := path.Join(l.Dir, cleanerDir)
+	assert.NoError(t, os.MkdirAll(cleaned, 0755))
+	assert.NoError(t, os.WriteFile(path.Join(cleaned, "3.store"), []byte("torn"), 0644))
+
+	l, err = newLog(l.Dir, l.Config)
+	assert.NoError(t, err, "error reopening log")
+	defer l.Close()
+	r, err := l.Read(0)
+	assert.NoError(t, err, "error reading record")
+	assert.Equal(t, uint64(2), r.Offset, "stale index is used")
+	r, err = l.Read(4)
+	assert.NoError(t, err, "error reading record")
+	assert.Equal(t, []byte{4}, r.Value, "stale index is used")
+	_, err = os.Stat(cleaned)
+	assert.True(t, os.IsNotExist(err), "cleaner directory is left")
+}
+
+// timeOf returns the append time of the record at offset.
+func timeOf(t *testing.T, l *Log, offset uint64) time.Time {
+	t.Helper()
+	r, err := l.Read(offset)
+	assert.NoError(t, err, "error reading record")
+	return time.Unix(0, r.AppendTime)
+}
+
+func TestCompactTombstones(t *testing.T) {
+	// segments 0-2, 3-5 are closed, 6 is in the active segment
+	records := keyed("b", "x", "a")
+	records = append(records,
+		&api.Record{Key: []byte("a"), Tombstone: true},
+		&api.Record{Key: []byte("b"), Tombstone: true},
+		&api.Record{Key: []byte("y"), Value: []byte{5}},
+		&api.Record{Key: []byte("z"), Value: []byte{6}},
+	)
+	l := newCompactionLog(t, records...)
+	_, err := l.Append(&api.Record{Tombstone: true})
+	assert.Equal(t, ErrInvalidTombstone, err, "tombstone without a key is appended")
+	_, err = l.AppendBatch([]*api.Record{{Key: []byte("a"), Value: []byte("a"), Tombstone: true}})
+	assert.Equal(t, ErrInvalidTombstone, err, "tombstone with a value is appended")
+
+	now := time.Now()
+	assert.NoError(t, l.compact(now), "error compacting log")
+	r, err := l.Read(0)
+	assert.NoError(t, err, "error reading record")
+	assert.Equal(t, uint64(1), r.Offset, "record superseded by a tombstone is kept")
+	r, err = l.Read(4)
+	assert.NoError(t, err, "error reading record")
+	assert.True(t, r.Tombstone, "tombstone isn't read as one")
+	assert.Empty(t, r.Value, "tombstone has a value")
+
+	// past the delete retention the tombstone of b goes, a still has a record as the last one of segment 0
+	// so its tombstone stays
+	assert.NoError(t, l.compact(now.Add(l.Config.Compaction.DeleteRetention+time.Second)), "error compacting log")
+	r, err = l.Read(4)
+	assert.NoError(t, err, "error reading record")
+	assert.Equal(t, uint64(5), r.Offset, "tombstone is kept past the delete retention")
+	r, err = l.Read(3)
+	assert.NoError(t, err, "error reading record")
+	assert.Equal(t, uint64(3), r.Offset, "tombstone of a key with a record left is dropped")
+	assert.True(t, r.Tombstone, "tombstone isn't read as one")
+}
@@ -0,0 +1,82 @@
+package log
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"sync"
+)
+
+// Codec
+// is what the records of a store are compressed with, a block at a time, see block.go. It is kept in the flags
+// of the store header, so a segment keeps the codec it was created with whatever the configuration says now,
+// and every block records the codec it was compressed with.
+type Codec uint16
+
+const (
+	CodecNone Codec = iota
+	CodecGzip
+	CodecFlate
+	CodecZlib
+)
+
+// codec returns the codec the records of the store are compressed with.
+func (h header) codec() Codec {
+	return Codec(h.Flags & flagsCodec)
+}
+
+// compressor is a writer of a codec, they are pooled as every one allocates its buffers.
+type compressor interface {
+	io.WriteCloser
+	Reset(io.Writer)
+}
+
+var compressors = map[Codec]*sync.Pool{
+	CodecGzip: {New: func() any { return gzip.NewWriter(nil) }},
+	CodecFlate: {New: func() any {
+		// only fails for an invalid level
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	}},
+	CodecZlib: {New: func() any { return zlib.NewWriter(nil) }},
+}
+
+func (c Codec) compress(b []byte) ([]byte, error) {
+	pool, ok := compressors[c]
+	if !ok {
+		return b, nil
+	}
+	w := pool.Get().(compressor)
+	defer pool.Put(w)
+	var buf bytes.Buffer
+	w.Reset(&buf)
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c Codec) decompress(b []byte) ([]byte, error) {
+	var r io.ReadCloser
+	var err error
+	switch c {
+	case CodecGzip:
+		r, err = gzip.NewReader(bytes.NewReader(b))
+	case CodecFlate:
+		r = flate.NewReader(bytes.NewReader(b))
+	case CodecZlib:
+		r, err = zlib.NewReader(bytes.NewReader(b))
+	default:
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
@@ -0,0 +1,134 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	api "github.com/adityavit/dslog/api/v1"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestCompression(t *testing.T) {
+	value := bytes.Repeat([]byte(`{"level":"info","msg":"hello world"}`), 20)
+	var uncompressed uint64
+	for _, codec := range []Codec{CodecNone, CodecGzip, CodecFlate, CodecZlib} {
+		dir, err := os.MkdirTemp("", "compression_test")
+		assert.NoError(t, err, "error creating dir")
+		defer os.RemoveAll(dir)
+		c := Config{}
+		c.Segment.MaxStoreBytes = 1 << 20
+		c.Segment.Codec = codec
+		l, err := newLog(dir, c)
+		assert.NoError(t, err, "error creating log")
+		_, err = l.Append(&api.Record{Value: value})
+		assert.NoError(t, err, "error appending record")
+		r, err := l.Read(0)
+		assert.NoError(t, err, "error reading record")
+		assert.Equal(t, value, r.Value, "unexpected value read")
+		size := l.activeSegment.store.size
+		if codec == CodecNone {
+			uncompressed = size
+		} else {
+			assert.Less(t, size, uncompressed/5, "record isn't compressed")
+		}
+
+		// the segment keeps its codec, the next one gets the configured one
+		assert.NoError(t, l.Close(), "error closing log")
+		c.Segment.Codec = CodecZlib - codec
+		c.Segment.MaxRecords = 2
+		l, err = newLog(dir, c)
+		assert.NoError(t, err, "error reopening log")
+		for i := 0; i < 2; i++ {
+			_, err = l.Append(&api.Record{Value: value})
+			assert.NoError(t, err, "error appending record")
+		}
+		assert.Equal(t, codec, l.segments[0].store.header.codec(), "codec of segment is changed")
+		assert.Equal(t, c.Segment.Codec, l.activeSegment.store.header.codec(), "new segment doesn't get configured codec")
+		for off := uint64(0); off < 3; off++ {
+			r, err := l.Read(off)
+			assert.NoError(t, err, "error reading record")
+			assert.Equal(t, value, r.Value, "unexpected value read")
+		}
+		assert.NoError(t, l.Close(), "error closing log")
+	}
+}
+
+func TestCompressionSize(t *testing.T) {
+	var records []*api.Record
+	for i := 0; i < 100; i++ {
+		records = append(records, &api.Record{Value: []byte(fmt.Sprintf(
+			`{"time":"2024-05-01T12:00:%02d Z","level":"info","service":"checkout","msg":"order placed","order":%d}`, i%60, 1000+i,
+		))})
+	}
+	var batched, single uint64
+	for _, codec := range []Codec{CodecNone, CodecGzip, CodecFlate, CodecZlib} {
+		c := Config{}
+		c.Segment.MaxStoreBytes = 1 << 20
+		c.Segment.MaxIndexBytes = 1 << 20
+		c.Segment.Codec = codec
+		dir, err := os.MkdirTemp("", "compression_test")
+		assert.NoError(t, err, "error creating dir")
+		defer os.RemoveAll(dir)
+		l, err := newLog(dir, c)
+		assert.NoError(t, err, "error creating log")
+		_, err = l.AppendBatch(records)
+		assert.NoError(t, err, "error appending batch")
+		assert.NoError(t, l.Close(), "error closing log")
+		fi, err := os.Stat(path.Join(dir, fmt.Sprintf("0%s", storeExt)))
+		assert.NoError(t, err, "error reading store size")
+		if codec == CodecNone {
+			batched = uint64(fi.Size())
+		} else {
+			assert.Less(t, uint64(fi.Size()), batched/3, "batch isn't compressed")
+		}
+
+		// records appended on their own are too small to compress, but don't get any bigger
+		dir, err = os.MkdirTemp("", "compression_test")
+		assert.NoError(t, err, "error creating dir")
+		defer os.RemoveAll(dir)
+		l, err = newLog(dir, c)
+		assert.NoError(t, err, "error creating log")
+		for _, r := range records[:10] {
+			_, err = l.Append(r)
+			assert.NoError(t, err, "error appending record")
+		}
+		assert.NoError(t, l.Close(), "error closing log")
+		fi, err = os.Stat(path.Join(dir, fmt.Sprintf("0%s", storeExt)))
+		assert.NoError(t, err, "error reading store size")
+		if codec == CodecNone {
+			single = uint64(fi.Size())
+		} else {
+			assert.LessOrEqual(t, uint64(fi.Size()), single, "compressed records are bigger")
+		}
+	}
+}
+
+func TestUnsupportedCodec(t *testing.T) {
+	f, err := os.CreateTemp("", "compression_test")
+	assert.NoError(t, err, "error creating file")
+	defer os.Remove(f.Name())
+	_, err = newStore(f, 0, Codec(flagsCodec))
+	assert.Error(t, err, "store with unknown codec is opened")
+	_, err = newStore(f, 0, Codec(flagsCodec)+1)
+	assert.Error(t, err, "store with codec outside the flags is opened")
+
+	// the log doesn't create any files with an unknown codec, and opens once the codec is fixed
+	dir, err := os.MkdirTemp("", "compression_test")
+	assert.NoError(t, err, "error creating dir")
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.Codec = CodecZlib + 1
+	_, err = newLog(dir, c)
+	assert.Error(t, err, "log with unknown codec is opened")
+	files, err := os.ReadDir(dir)
+	assert.NoError(t, err, "error reading dir")
+	assert.Empty(t, files, "log with unknown codec creates files")
+	c.Segment.Codec = CodecGzip
+	l, err := newLog(dir, c)
+	assert.NoError(t, err, "error creating log")
+	_, err = l.Append(&api.Record{Value: []byte("hello world")})
+	assert.NoError(t, err, "error appending record")
+	assert.NoError(t, l.Close(), "error closing log")
+}
@@ -1,9 +1,70 @@
 package log
 
+import "time"
+
 type Config struct {
 	Segment struct {
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
 		InitialOffset uint64
+		// TimeIndexInterval is the number of records between entries of the time index.
+		TimeIndexInterval uint64
+		// MaxSegmentAge rolls the active segment once its first record is that old, checked on append and
+		// every tenth of it, and MaxRecords once it holds that many records. 0 only rolls full segments.
+		MaxSegmentAge time.Duration
+		MaxRecords    uint64
+		// Codec compresses the records of new segments, existing ones keep the codec they were written with.
+		Codec Codec
+		// MaxOpenSegments is how many closed segments keep their files open, the least recently read ones are
+		// closed beyond it and opened again when they are read. 0 keeps every segment open once it is read.
+		// Closed segments are only opened when they are first read, the active segment is always open.
+		MaxOpenSegments int
+	}
+	Retention struct {
+		// MaxBytes is the size the segments of the log are kept under, 0 keeps everything.
+		MaxBytes uint64
+		// MaxAge is how long a segment is kept after its last record was appended, 0 keeps everything.
+		MaxAge time.Duration
+		// CheckInterval is how often the janitor looks for segments to delete.
+		CheckInterval time.Duration
+	}
+	Compaction struct {
+		// Enabled makes a background cleaner compact the closed segments every Interval, see Log.Compact.
+		Enabled  bool
+		Interval time.Duration
+		// DeleteRetention is how long a tombstone is kept after it was appended,
+		// consumers have that long to see the delete before compaction drops it.
+		DeleteRetention time.Duration
+	}
+	Merge struct {
+		// Enabled makes a background task merge small closed segments every Interval, see Log.Merge.
+		Enabled  bool
+		Interval time.Duration
 	}
-}
\ No newline at end of file
+	Durability struct {
+		Mode DurabilityMode
+		// SyncRecords and SyncInterval bound how many records DurabilityInterval can lose,
+		// the background flusher syncs after that many records or that much time, whichever comes first.
+		SyncRecords  uint64
+		SyncInterval time.Duration
+	}
+}
+
+// DurabilityMode
+// decides what an acknowledged append survives, Log.Append only returns once the guarantee is met.
+// Only the store is ever synced, the index is rebuilt from it after a crash.
+type DurabilityMode int
+
+const (
+	// DurabilityBuffered acknowledges records once they are in the buffer of the store,
+	// they are lost if the process crashes.
+	DurabilityBuffered DurabilityMode = iota
+	// DurabilityOS acknowledges records once they are written to the operating system,
+	// they survive the process crashing but not the machine.
+	DurabilityOS
+	// DurabilityInterval acknowledges records once they are written to the operating system and
+	// syncs them to disk from a background flusher, the machine crashing loses at most the records since the last sync.
+	DurabilityInterval
+	// DurabilitySync acknowledges records once they are synced to disk, they survive the machine crashing.
+	DurabilitySync
+)
@@ -0,0 +1,75 @@
+package log
+
+// commit
+// makes the records appended to seg meet the durability mode of the log before they are acknowledged.
+func (l *Log) commit(seg *segment, records uint64) error {
+	if err := l.backgroundErr(); err != nil {
+		return err
+	}
+	switch l.Config.Durability.Mode {
+	case DurabilityOS:
+		return seg.Flush()
+	case DurabilityInterval:
+		if err := seg.Flush(); err != nil {
+			return err
+		}
+		n := l.unsynced.Add(records)
+		if max := l.Config.Durability.SyncRecords; max > 0 && n >= max {
+			// wake the flusher up, unless it already has been
+			select {
+			case l.syncc <- struct{}{}:
+			default:
+			}
+		}
+	case DurabilitySync:
+		return seg.Sync()
+	}
+	return nil
+}
+
+// syncActive is run by the background flusher of DurabilityInterval.
+func (l *Log) syncActive() {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.unsynced.Swap(0) == 0 {
+		return
+	}
+	if err := l.activeSegment.Sync(); err != nil {
+		l.setBackgroundErr(err)
+	}
+}
+
+// setBackgroundErr
+// records the failure of a background task. A failed sync may have lost acknowledged records,
+// so it is reported by every append from then on.
+func (l *Log) setBackgroundErr(err error) {
+	l.errMu.Lock()
+	defer l.errMu.Unlock()
+	if l.bgErr == nil {
+		l.bgErr = err
+	}
+}
+
+func (l *Log) backgroundErr() error {
+	l.errMu.Lock()
+	defer l.errMu.Unlock()
+	return l.bgErr
+}
+
+// maintain
+// wraps a background maintenance task, its failures don't stop appends but are kept for MaintenanceErr.
+func (l *Log) maintain(task func() error) func() {
+	return func() {
+		err := task()
+		l.errMu.Lock()
+		defer l.errMu.Unlock()
+		l.maintErr = err
+	}
+}
+
+// MaintenanceErr returns the error of the last background maintenance task which ran, nil if it succeeded.
+func (l *Log) MaintenanceErr() error {
+	l.errMu.Lock()
+	defer l.errMu.Unlock()
+	return l.maintErr
+}
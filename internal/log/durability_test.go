@@ -0,0 +1,60 @@
+package log
+
+import (
+	api "github.com/adityavit/dslog/api/v1"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDurability(t *testing.T) {
+	testCases := map[string]struct {
+		mode    DurabilityMode
+		written bool // the record reached the file when append returns
+	}{
+		"buffered": {DurabilityBuffered, false},
+		"os":       {DurabilityOS, true},
+		"interval": {DurabilityInterval, true},
+		"sync":     {DurabilitySync, true},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "durability_test")
+			assert.NoError(t, err, "error creating dir")
+			defer os.RemoveAll(dir)
+			c := Config{}
+			c.Durability.Mode = tc.mode
+			l, err := newLog(dir, c)
+			assert.NoError(t, err, "error creating log")
+			_, err = l.Append(&api.Record{Value: []byte("hello world")})
+			assert.NoError(t, err, "error appending record")
+			fi, err := os.Stat(l.activeSegment.store.Name())
+			assert.NoError(t, err, "error reading store size")
+			assert.Equal(t, tc.written, uint64(fi.Size()) == l.activeSegment.store.size, "record written to the file")
+			assert.NoError(t, l.Close())
+		})
+	}
+}
+
+func TestDurabilityIntervalFlusher(t *testing.T) {
+	dir, err := os.MkdirTemp("", "durability_interval_test")
+	assert.NoError(t, err, "error creating dir")
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Durability.Mode = DurabilityInterval
+	c.Durability.SyncRecords = 2
+	c.Durability.SyncInterval = time.Hour
+	l, err := newLog(dir, c)
+	assert.NoError(t, err, "error creating log")
+	defer l.Close()
+	rec := &api.Record{Value: []byte("hello world")}
+	_, err = l.Append(rec)
+	assert.NoError(t, err, "error appending record")
+	assert.Equal(t, uint64(1), l.unsynced.Load(), "a single record should not be synced yet")
+	_, err = l.Append(rec)
+	assert.NoError(t, err, "error appending record")
+	assert.Eventually(t, func() bool {
+		return l.unsynced.Load() == 0
+	}, time.Second, time.Millisecond, "flusher doesn't sync after SyncRecords records")
+}
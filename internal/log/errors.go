@@ -0,0 +1,52 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrEmptyBatch    = errors.New("batch has no records")
+	ErrBatchTooLarge = errors.New("batch doesn't fit in a segment")
+	// ErrInvalidTombstone is returned when appending a tombstone without a key or with a value.
+	ErrInvalidTombstone = errors.New("tombstone needs a key and no value")
+	// ErrHeld is returned when deleting segments which hold offsets under a hold.
+	ErrHeld         = errors.New("offsets are under a hold")
+	ErrHoldNotFound = errors.New("hold not found")
+	// ErrOffsetTruncated matches an ErrOffsetOutOfRange for an offset below the lowest one,
+	// its record was deleted by retention or truncation.
+	ErrOffsetTruncated = errors.New("offset was truncated")
+	// ErrCorrupt matches every error for corrupt data, such as ErrCorruptRecord.
+	ErrCorrupt = errors.New("corrupt data")
+)
+
+// ErrCorruptRecord is returned when a record read from a store is truncated
+// or fails its checksum.
+type ErrCorruptRecord struct {
+	BaseOffset uint64 // base offset of the segment holding the record
+	Pos        uint64 // position of the record in the store
+}
+
+func (e ErrCorruptRecord) Error() string {
+	return fmt.Sprintf("corrupt record in segment %d at position %d", e.BaseOffset, e.Pos)
+}
+
+func (e ErrCorruptRecord) Is(target error) bool {
+	return target == ErrCorrupt
+}
+
+// ErrOffsetOutOfRange is returned when reading an offset the log holds no record at or after,
+// with the lowest and highest offsets of the log at the time.
+type ErrOffsetOutOfRange struct {
+	Offset  uint64
+	Lowest  uint64
+	Highest uint64
+}
+
+func (e ErrOffsetOutOfRange) Error() string {
+	return fmt.Sprintf("offset %d out of range [%d, %d]", e.Offset, e.Lowest, e.Highest)
+}
+
+func (e ErrOffsetOutOfRange) Is(target error) bool {
+	return target == ErrOffsetTruncated && e.Offset < e.Lowest
+}
@@ -0,0 +1,130 @@
+package log
+
+import (
+	api "github.com/adityavit/dslog/api/v1"
+)
+
+// appendReq is an append waiting for the group it is part of to be committed.
+type appendReq struct {
+	records []*api.Record // appended atomically with contiguous offsets
+	offset  uint64        // of the first record
+	err     error
+	lead    bool          // the waiter has to lead the next group instead of returning
+	wake    chan struct{} // closed once the append is committed, or lead is set
+}
+
+// groupAppend
+// queues the append and waits for it to be committed. Appends queued while a group is being committed
+// form the next group, which is written with a single flush and sync by the first of them.
+func (l *Log) groupAppend(records []*api.Record) (uint64, error) {
+	req := &appendReq{records: records, wake: make(chan struct{})}
+	l.groupMu.Lock()
+	l.pending = append(l.pending, req)
+	lead := !l.committing
+	l.committing = true
+	l.groupMu.Unlock()
+	if !lead {
+		<-req.wake
+		if !req.lead {
+			return req.offset, req.err
+		}
+	}
+	l.leadGroup()
+	return req.offset, req.err
+}
+
+// leadGroup commits the pending appends as one group, then hands leadership on to the oldest waiter
+// so the leader doesn't keep committing other groups while its own caller waits.
+func (l *Log) leadGroup() {
+	l.groupMu.Lock()
+	group := l.pending
+	l.pending = nil
+	l.groupMu.Unlock()
+
+	l.commitGroup(group)
+	for _, req := range group {
+		if !req.lead {
+			close(req.wake)
+		}
+	}
+
+	l.groupMu.Lock()
+	defer l.groupMu.Unlock()
+	if len(l.pending) == 0 {
+		l.committing = false
+		return
+	}
+	next := l.pending[0]
+	next.lead = true
+	close(next.wake)
+}
+
+// commitGroup
+// appends the batches of the group and commits them at once. A segment filled up in the middle
+// of the group is committed before the log rolls over to a new one, and a batch which doesn't fit
+// in what is left of the active segment goes into a new one, so a batch is never split across segments.
+func (l *Log) commitGroup(group []*appendReq) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var written uint64   // records staged in the active segment but not committed yet
+	var mark segmentMark // where the active segment ended before them
+	var uncommitted []*appendReq
+	commit := func() error {
+		if written == 0 {
+			return nil
+		}
+		// the records of the group committed together are written in one block
+		err := l.activeSegment.writeStaged()
+		if err == nil {
+			err = l.commit(l.activeSegment, written)
+		}
+		if err == nil {
+			// readers see the records once they meet the durability mode
+			l.activeSegment.publish()
+		} else {
+			for _, req := range uncommitted {
+				req.err = err
+			}
+			// the records are dropped, so a later commit doesn't publish appends which were reported as failed
+			if rbErr := l.activeSegment.rollback(mark); rbErr != nil {
+				l.setBackgroundErr(rbErr)
+			}
+		}
+		written, uncommitted = 0, uncommitted[:0]
+		return err
+	}
+	appendTime := l.appendTime()
+	if l.activeSegment.aged(appendTime) {
+		if err := l.newSegment(l.activeSegment.nextOffset); err != nil {
+			for _, req := range group {
+				req.err = err
+			}
+			return
+		}
+	}
+	for _, req := range group {
+		for _, r := range req.records {
+			r.AppendTime = appendTime
+		}
+		if !l.activeSegment.fits(req.records) {
+			commit()
+			if req.err = l.newSegment(l.activeSegment.nextOffset); req.err != nil {
+				continue
+			}
+		}
+		if written == 0 {
+			mark = l.activeSegment.mark()
+		}
+		req.offset, req.err = l.activeSegment.stageBatch(req.records)
+		if req.err != nil {
+			continue
+		}
+		written += uint64(len(req.records))
+		uncommitted = append(uncommitted, req)
+		if l.activeSegment.IsMaxed() && commit() == nil {
+			// the records are committed, if rolling over fails the next append, which doesn't fit, tries again
+			l.newSegment(l.activeSegment.nextOffset)
+		}
+	}
+	commit()
+}
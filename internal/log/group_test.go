@@ -0,0 +1,95 @@
+package log
+
+import (
+	api "github.com/adityavit/dslog/api/v1"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGroupAppend(t *testing.T) {
+	dir, err := os.MkdirTemp("", "group_append_test")
+	assert.NoError(t, err, "error creating dir")
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 4096
+	c.Segment.MaxIndexBytes = entWidth * 64
+	c.Durability.Mode = DurabilitySync
+	l, err := newLog(dir, c)
+	assert.NoError(t, err, "error creating log")
+	defer l.Close()
+
+	const appenders, perAppender = 50, 20
+	// hold the log so the first appends queue up behind the leader
+	l.mu.Lock()
+	var wg sync.WaitGroup
+	offsets := make(chan uint64, appenders*perAppender)
+	for i := 0; i < appenders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perAppender; j++ {
+				off, err := l.Append(&api.Record{Value: []byte("hello world")})
+				assert.NoError(t, err, "error appending record")
+				offsets <- off
+			}
+		}()
+	}
+	assert.Eventually(t, func() bool {
+		l.groupMu.Lock()
+		defer l.groupMu.Unlock()
+		return len(l.pending) == appenders-1
+	}, time.Second, time.Millisecond, "appends don't queue behind the leader")
+	l.mu.Unlock()
+	wg.Wait()
+	close(offsets)
+
+	var got []uint64
+	for off := range offsets {
+		got = append(got, off)
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+	for i, off := range got {
+		assert.Equal(t, uint64(i), off, "offsets are not unique and contiguous")
+		rec, err := l.Read(off)
+		assert.NoError(t, err, "error reading record")
+		assert.Equal(t, off, rec.Offset, "record read doesn't match the offset")
+	}
+	assert.Greater(t, len(l.segments), 1, "log should have rolled during the groups")
+}
+
+func TestGroupAppendFailed(t *testing.T) {
+	dir, err := os.MkdirTemp("", "group_append_test")
+	assert.NoError(t, err, "error creating dir")
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Durability.Mode = DurabilityOS
+	l, err := newLog(dir, c)
+	assert.NoError(t, err, "error creating log")
+	defer l.Close()
+	_, err = l.Append(&api.Record{Value: []byte("first")})
+	assert.NoError(t, err, "error appending record")
+
+	// writing the store fails while it is only open for reading
+	store := l.activeSegment.store
+	f := store.File
+	store.File, err = os.Open(f.Name())
+	assert.NoError(t, err, "error opening store")
+	_, err = l.Append(&api.Record{Value: []byte("failed")})
+	assert.Error(t, err, "failed commit is acknowledged")
+	assert.NoError(t, store.File.Close())
+	store.File = f
+
+	// the failed record is dropped, not committed along with the next group
+	off, err := l.Append(&api.Record{Value: []byte("second")})
+	assert.NoError(t, err, "error appending record")
+	assert.Equal(t, uint64(1), off, "offset of the failed record isn't reused")
+	rec, err := l.Read(1)
+	assert.NoError(t, err, "error reading record")
+	assert.Equal(t, []byte("second"), rec.Value, "failed record is read")
+	_, err = l.Read(2)
+	assert.Error(t, err, "failed record is read")
+}
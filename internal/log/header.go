@@ -0,0 +1,136 @@
+package log
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	headerWidth = 32 // magic 4, version 2, flags 2, base offset 8, creation time 8, reserved 8
+
+	// legacyVersion is the format of files written before headers existed: no header and records framed
+	// by their length only. Such files are still read, new files are always written with formatVersion.
+	legacyVersion uint16 = 1
+	// recordVersion is the format of stores whose records are framed and compressed one by one.
+	// Such stores are still read, new ones write their records in blocks, see block.go.
+	recordVersion uint16 = 2
+	formatVersion uint16 = 3
+
+	flagsCodec uint16 = 0x000f // the Codec the records of a store are compressed with
+)
+
+var (
+	storeMagic = [4]byte{'D', 'S', 'L', 'S'}
+	indexMagic = [4]byte{'D', 'S', 'L', 'I'}
+
+	ErrUnsupportedVersion = errors.New("unsupported segment file version")
+)
+
+// header
+// is written at the start of every segment file, it identifies the file and the format of what follows.
+type header struct {
+	Magic      [4]byte
+	Version    uint16
+	Flags      uint16 // bits describing how the records are encoded, the codec of a store is in flagsCodec
+	BaseOffset uint64
+	CreatedAt  int64 // unix nanoseconds
+}
+
+func (h header) encode() []byte {
+	b := make([]byte, headerWidth)
+	copy(b[0:4], h.Magic[:])
+	enc.PutUint16(b[4:6], h.Version)
+	enc.PutUint16(b[6:8], h.Flags)
+	enc.PutUint64(b[8:16], h.BaseOffset)
+	enc.PutUint64(b[16:24], uint64(h.CreatedAt))
+	return b
+}
+
+func decodeHeader(b []byte) header {
+	h := header{
+		Version:    enc.Uint16(b[4:6]),
+		Flags:      enc.Uint16(b[6:8]),
+		BaseOffset: enc.Uint64(b[8:16]),
+		CreatedAt:  int64(enc.Uint64(b[16:24])),
+	}
+	copy(h.Magic[:], b[0:4])
+	return h
+}
+
+// Created returns the time the file was created at, the zero time for files which predate headers.
+func (h header) Created() time.Time {
+	if h.CreatedAt == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, h.CreatedAt)
+}
+
+// setupHeader
+// reads and validates the header of f, which holds the segment starting at baseOffset, and returns it with
+// the size of the file. An empty file, or one whose header was torn while it was being created, gets a new
+// header with the current version and flags. A file not starting with magic predates headers and is legacyVersion.
+func setupHeader(f *os.File, magic [4]byte, baseOffset uint64, flags uint16) (header, uint64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return header{}, 0, err
+	}
+	size := uint64(fi.Size())
+	b := make([]byte, headerWidth)
+	n, err := f.ReadAt(b, 0)
+	if err != nil && err != io.EOF {
+		return header{}, 0, err
+	}
+	if size > 0 && (n < len(magic) || !bytes.Equal(b[:len(magic)], magic[:])) {
+		return header{Version: legacyVersion, BaseOffset: baseOffset}, size, nil
+	}
+	if size < headerWidth {
+		h := header{
+			Magic:      magic,
+			Version:    formatVersion,
+			Flags:      flags,
+			BaseOffset: baseOffset,
+			CreatedAt:  time.Now().UnixNano(),
+		}
+		if err = f.Truncate(0); err != nil {
+			return header{}, 0, err
+		}
+		if _, err = f.Write(h.encode()); err != nil {
+			return header{}, 0, err
+		}
+		return h, headerWidth, nil
+	}
+	h := decodeHeader(b)
+	if h.Version <= legacyVersion || h.Version > formatVersion {
+		return header{}, 0, fmt.Errorf("%s: %w %d", f.Name(), ErrUnsupportedVersion, h.Version)
+	}
+	if h.BaseOffset != baseOffset {
+		return header{}, 0, fmt.Errorf("%s: header is for base offset %d", f.Name(), h.BaseOffset)
+	}
+	return h, size, nil
+}
+
+// readHeader reads the header of the file name without changing it.
+func readHeader(name string) (header, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return header{}, err
+	}
+	defer f.Close()
+	b := make([]byte, headerWidth)
+	if _, err = f.ReadAt(b, 0); err != nil {
+		return header{}, err
+	}
+	return decodeHeader(b), nil
+}
+
+// start returns where the content following the header begins.
+func (h header) start() uint64 {
+	if h.Version == legacyVersion {
+		return 0
+	}
+	return headerWidth
+}
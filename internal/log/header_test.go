@@ -0,0 +1,135 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	api "github.com/adityavit/dslog/api/v1"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"hash/crc32"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestHeader(t *testing.T) {
+	f, err := os.CreateTemp("", "header_test")
+	assert.NoError(t, err, "error creating temp file")
+	defer os.Remove(f.Name())
+
+	h, size, err := setupHeader(f, storeMagic, 16, 0)
+	assert.NoError(t, err, "error writing header to empty file")
+	assert.Equal(t, uint64(headerWidth), size, "header is not written")
+	assert.Equal(t, formatVersion, h.Version, "new files don't get the current version")
+	read, _, err := setupHeader(f, storeMagic, 16, 0)
+	assert.NoError(t, err, "error reading header")
+	assert.Equal(t, h, read, "header read doesn't match the one written")
+
+	_, _, err = setupHeader(f, storeMagic, 32, 0)
+	assert.Error(t, err, "header for another base offset is accepted")
+
+	h.Version = formatVersion + 1
+	_, err = f.WriteAt(h.encode(), 0)
+	assert.NoError(t, err, "error rewriting header")
+	_, _, err = setupHeader(f, storeMagic, 16, 0)
+	assert.True(t, errors.Is(err, ErrUnsupportedVersion), "newer version is accepted")
+
+	// a file which doesn't start with the magic bytes predates headers
+	_, err = f.WriteAt([]byte{0, 0, 0, 0}, 0)
+	assert.NoError(t, err, "error rewriting header")
+	h, _, err = setupHeader(f, storeMagic, 16, 0)
+	assert.NoError(t, err, "error reading legacy file")
+	assert.Equal(t, legacyVersion, h.Version, "file without header is not legacy")
+}
+
+func TestLegacySegment(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "legacy_segment_test")
+	defer os.RemoveAll(dir)
+	// write a segment the way it was written before headers and checksums
+	var store, index []byte
+	for i := 0; i < 2; i++ {
+		b, err := proto.Marshal(&api.Record{Value: []byte("hello world"), Offset: uint64(i)})
+		assert.NoError(t, err, "error marshaling record")
+		entry := make([]byte, entWidth)
+		enc.PutUint32(entry[:offWidth], uint32(i))
+		enc.PutUint64(entry[offWidth:], uint64(len(store)))
+		index = append(index, entry...)
+		length := make([]byte, lenWidth)
+		enc.PutUint64(length, uint64(len(b)))
+		store = append(append(store, length...), b...)
+	}
+	assert.NoError(t, os.WriteFile(path.Join(dir, fmt.Sprintf("0%s", storeExt)), store, 0644))
+	assert.NoError(t, os.WriteFile(path.Join(dir, fmt.Sprintf("0%s", indexExt)), index, 0644))
+
+	c := Config{}
+	l, err := newLog(dir, c)
+	assert.NoError(t, err, "error opening legacy log")
+	assert.Empty(t, l.Recovered(), "legacy segment should not need repairs")
+	for off := uint64(0); off < 2; off++ {
+		r, err := l.Read(off)
+		assert.NoError(t, err, "error reading legacy record")
+		assert.Equal(t, off, r.Offset, "legacy record read from the wrong position")
+	}
+	off, err := l.Append(&api.Record{Value: []byte("hello world")})
+	assert.NoError(t, err, "error appending to legacy log")
+	assert.Equal(t, uint64(2), off, "append doesn't continue the legacy log")
+	assert.Equal(t, formatVersion, l.activeSegment.store.header.Version, "new records are written in the legacy format")
+	assert.Len(t, l.segments, 2, "legacy segment is not rolled")
+	assert.NoError(t, l.Close())
+}
+
+func TestRecordVersionSegment(t *testing.T) {
+	// write a segment the way it was written before blocks, its records framed and compressed one by one
+	writeSegment := func(dir string, records int) {
+		h := header{Magic: storeMagic, Version: recordVersion, Flags: uint16(CodecGzip)}
+		store := h.encode()
+		h.Magic, h.Flags = indexMagic, 0
+		index := h.encode()
+		for i := 0; i < records; i++ {
+			b, err := proto.Marshal(&api.Record{Value: []byte("hello world"), Offset: uint64(i)})
+			assert.NoError(t, err, "error marshaling record")
+			b, err = CodecGzip.compress(b)
+			assert.NoError(t, err, "error compressing record")
+			index = enc.AppendUint32(index, uint32(i))
+			index = enc.AppendUint64(index, uint64(len(store)))
+			store = enc.AppendUint64(store, uint64(len(b)))
+			store = enc.AppendUint32(store, crc32.Checksum(b, crcTable))
+			store = append(store, b...)
+		}
+		assert.NoError(t, os.WriteFile(path.Join(dir, fmt.Sprintf("0%s", storeExt)), store, 0644))
+		assert.NoError(t, os.WriteFile(path.Join(dir, fmt.Sprintf("0%s", indexExt)), index, 0644))
+	}
+
+	dir, _ := os.MkdirTemp("", "record_version_test")
+	defer os.RemoveAll(dir)
+	writeSegment(dir, 2)
+	l, err := newLog(dir, Config{})
+	assert.NoError(t, err, "error opening log")
+	assert.Empty(t, l.Recovered(), "segment should not need repairs")
+	for off := uint64(0); off < 2; off++ {
+		r, err := l.Read(off)
+		assert.NoError(t, err, "error reading record")
+		assert.Equal(t, off, r.Offset, "record read from the wrong position")
+	}
+	off, err := l.Append(&api.Record{Value: []byte("hello world")})
+	assert.NoError(t, err, "error appending record")
+	assert.Equal(t, uint64(2), off, "append doesn't continue the log")
+	assert.Equal(t, formatVersion, l.activeSegment.store.header.Version, "new records are written in the old format")
+	assert.Len(t, l.segments, 2, "segment is not rolled")
+	assert.NoError(t, l.Close())
+
+	// an empty segment is rewritten in the current format rather than rolled
+	dir, _ = os.MkdirTemp("", "record_version_test")
+	defer os.RemoveAll(dir)
+	writeSegment(dir, 0)
+	l, err = newLog(dir, Config{})
+	assert.NoError(t, err, "error opening log")
+	off, err = l.Append(&api.Record{Value: []byte("hello world")})
+	assert.NoError(t, err, "error appending record")
+	assert.Equal(t, uint64(0), off, "append doesn't start the log")
+	assert.Equal(t, formatVersion, l.activeSegment.store.header.Version, "new records are written in the old format")
+	assert.Len(t, l.segments, 1, "empty segment is rolled")
+	_, err = l.Read(0)
+	assert.NoError(t, err, "error reading record")
+	assert.NoError(t, l.Close())
+}
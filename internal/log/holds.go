@@ -0,0 +1,109 @@
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+)
+
+const holdsFile = "holds.json"
+
+// Hold
+// keeps the segments holding offsets From to To, both included, from being deleted until it is released.
+// A hold from 0 to math.MaxUint64 covers the entire log.
+type Hold struct {
+	Name string `json:"name"`
+	From uint64 `json:"from"`
+	To   uint64 `json:"to"`
+}
+
+// covers reports if the hold covers any offset of the segment.
+func (h Hold) covers(seg *segment) bool {
+	return h.From < seg.nextOffset && h.To >= seg.baseOffset
+}
+
+// Hold
+// places the hold named name on the offsets from to to, replacing the hold of the same name if there is one.
+// Holds are kept in the log directory and survive restarts.
+func (l *Log) Hold(name string, from, to uint64) error {
+	if name == "" || from > to {
+		return fmt.Errorf("invalid hold %q from %d to %d", name, from, to)
+	}
+	l.maintMu.Lock()
+	defer l.maintMu.Unlock()
+	holds := []Hold{{Name: name, From: from, To: to}}
+	for _, h := range l.holds {
+		if h.Name != name {
+			holds = append(holds, h)
+		}
+	}
+	return l.setHolds(holds)
+}
+
+// Release releases the hold named name, ErrHoldNotFound is returned if there is none.
+func (l *Log) Release(name string) error {
+	l.maintMu.Lock()
+	defer l.maintMu.Unlock()
+	var holds []Hold
+	for _, h := range l.holds {
+		if h.Name != name {
+			holds = append(holds, h)
+		}
+	}
+	if len(holds) == len(l.holds) {
+		return ErrHoldNotFound
+	}
+	return l.setHolds(holds)
+}
+
+// Holds returns the holds on the log sorted by name.
+func (l *Log) Holds() []Hold {
+	l.holdMu.Lock()
+	defer l.holdMu.Unlock()
+	return append([]Hold(nil), l.holds...)
+}
+
+// setHolds writes the holds to the log directory before they replace the ones of the log.
+// The maintenance tasks deleting segments run under maintMu, so changing the holds waits for them.
+func (l *Log) setHolds(holds []Hold) error {
+	sort.Slice(holds, func(i, j int) bool { return holds[i].Name < holds[j].Name })
+	b, err := json.MarshalIndent(holds, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = writeFileAtomic(path.Join(l.Dir, holdsFile), b); err != nil {
+		return err
+	}
+	l.holdMu.Lock()
+	defer l.holdMu.Unlock()
+	l.holds = holds
+	return nil
+}
+
+// held reports if any hold covers the segment, it is called under maintMu.
+func (l *Log) held(seg *segment) bool {
+	for _, h := range l.holds {
+		if h.covers(seg) {
+			return true
+		}
+	}
+	return false
+}
+
+// readHolds reads the holds kept in dir, there are none if the file doesn't exist.
+func readHolds(dir string) ([]Hold, error) {
+	b, err := os.ReadFile(path.Join(dir, holdsFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var holds []Hold
+	if err = json.Unmarshal(b, &holds); err != nil {
+		return nil, fmt.Errorf("invalid holds in %s: %w", dir, err)
+	}
+	return holds, nil
+}
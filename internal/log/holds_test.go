@@ -0,0 +1,53 @@
+package log
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestHolds(t *testing.T) {
+	c := Config{}
+	l := newRetentionLog(t, c)
+	assert.Error(t, l.Hold("", 0, 1), "hold without a name is placed")
+	assert.Error(t, l.Hold("legal", 3, 2), "hold of an empty range is placed")
+	assert.NoError(t, l.Hold("legal", 5, 5), "error placing hold")
+	assert.NoError(t, l.Hold("audit", 0, math.MaxUint64), "error placing hold")
+	assert.NoError(t, l.Hold("audit", 3, 4), "error replacing hold")
+	assert.Equal(t, []Hold{{Name: "audit", From: 3, To: 4}, {Name: "legal", From: 5, To: 5}}, l.Holds())
+
+	// segments 2-3 and 4-5 are held
+	assert.Equal(t, ErrHeld, l.Truncate(3), "held segment is truncated")
+	assert.Len(t, l.segments, 4, "segments are truncated with a held one")
+	assert.Equal(t, ErrHeld, l.Remove(), "held log is removed")
+	assert.Equal(t, ErrHeld, l.Reset(), "held log is reset")
+	l.Config.Retention.MaxBytes = 1
+	assert.NoError(t, l.applyRetention(time.Now()), "error applying retention")
+	lOffset, err := l.LowestOffset()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), lOffset, "retention deletes held segment")
+
+	// holds survive a restart
+	assert.NoError(t, l.Close(), "error closing log")
+	l, err = newLog(l.Dir, l.Config)
+	assert.NoError(t, err, "error reopening log")
+	assert.Len(t, l.Holds(), 2, "holds are lost on restart")
+
+	assert.Equal(t, ErrHoldNotFound, l.Release("unknown"), "unknown hold is released")
+	assert.NoError(t, l.Release("audit"), "error releasing hold")
+	assert.NoError(t, l.Truncate(3), "error truncating released segment")
+	assert.Equal(t, ErrHeld, l.Truncate(5), "held segment is truncated")
+	assert.NoError(t, l.Release("legal"), "error releasing hold")
+	assert.Empty(t, l.Holds(), "released holds are listed")
+	assert.NoError(t, l.Remove(), "error removing log")
+}
+
+func TestHoldCompaction(t *testing.T) {
+	l := newCompactionLog(t, keyed("a", "b", "a", "", "a", "b", "a")...)
+	assert.NoError(t, l.Hold("legal", 1, 1), "error placing hold")
+	assert.NoError(t, l.Compact(), "error compacting log")
+	r, err := l.Read(0)
+	assert.NoError(t, err, "error reading record")
+	assert.Equal(t, uint64(0), r.Offset, "held segment is compacted")
+}
@@ -3,6 +3,7 @@ package log
 import (
 	"io"
 	"os"
+	"sync/atomic"
 )
 import "github.com/tysonmote/gommap"
 
@@ -13,37 +14,126 @@ var (
 )
 
 type index struct {
-	file *os.File    // indexed file
-	mmap gommap.MMap // Memory mapped file of the indexed file
-	size uint64      // size of the index, where to add the next index
+	file     *os.File      // indexed file
+	mmap     gommap.MMap   // Memory mapped file of the indexed file
+	writable bool          // the mapping is preallocated to MaxIndexBytes and takes writes, see seal
+	size     atomic.Uint64 // size of the index entries, where to add the next index after start, read without the lock
+	header   header
+	start    uint64 // where the entries start after the file header
 }
 
-func newIndex(f *os.File, c Config) (*index, error) {
+func newIndex(f *os.File, baseOffset uint64, c Config) (*index, error) {
 	idx := &index{
 		file: f,
 	}
-	fi, err := os.Stat(f.Name())
+	h, size, err := setupHeader(f, indexMagic, baseOffset, 0)
 	if err != nil {
 		return nil, err
 	}
-	idx.size = uint64(fi.Size())
-	// Why the truncation of the file is done?
-	// Growing the index file to max size before memory mapping the file
-	// Increase the size of the file to the MaxIndexBytes, as once memory mapped, size cannot be changed.
-	if err = os.Truncate(f.Name(), int64(c.Segment.MaxIndexBytes)); err != nil {
+	idx.header = h
+	idx.start = h.start()
+	idx.size.Store(size - idx.start)
+	if err = idx.mapFile(c.Segment.MaxIndexBytes, true); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// openSealedIndex
+// opens the index of a closed segment as it was sealed, mapped read-only without the file being grown.
+func openSealedIndex(f *os.File, baseOffset uint64) (*index, error) {
+	idx := &index{
+		file: f,
+	}
+	h, size, err := setupHeader(f, indexMagic, baseOffset, 0)
+	if err != nil {
 		return nil, err
 	}
-	if idx.mmap, err = gommap.Map(idx.file.Fd(), gommap.PROT_READ|gommap.PROT_WRITE, gommap.MAP_SHARED); err != nil {
+	idx.header = h
+	idx.start = h.start()
+	idx.size.Store(size - idx.start)
+	// an empty file can't be mapped, there are no entries to read from it anyway
+	if size == 0 {
+		return idx, nil
+	}
+	if idx.mmap, err = gommap.Map(f.Fd(), gommap.PROT_READ, gommap.MAP_SHARED); err != nil {
 		return nil, err
 	}
 	return idx, nil
 }
 
-func (i *index) Close() error {
+// mapFile
+// sizes the file to hold n bytes of entries and maps it, read-write if writable.
+func (i *index) mapFile(n uint64, writable bool) error {
+	// Why the truncation of the file is done?
+	// Growing the index file to max size before memory mapping the file
+	// Increase the size of the file to the MaxIndexBytes, as once memory mapped, size cannot be changed.
+	if err := i.file.Truncate(int64(i.start + n)); err != nil {
+		return err
+	}
+	i.writable = writable
+	// an empty file can't be mapped, there are no entries to read from it anyway
+	if i.start+n == 0 {
+		return nil
+	}
+	prot := gommap.PROT_READ
+	if writable {
+		prot |= gommap.PROT_WRITE
+	}
+	var err error
+	i.mmap, err = gommap.Map(i.file.Fd(), prot, gommap.MAP_SHARED)
+	return err
+}
+
+// unmap flushes the mapping of the file if it takes writes, and drops it.
+func (i *index) unmap() error {
+	if i.mmap == nil {
+		return nil
+	}
 	// Flush the memory map of the file; Flushing is done synchronously with MS_SYNC flag
-	if err := i.mmap.Sync(gommap.MS_SYNC); err != nil {
+	if i.writable {
+		if err := i.mmap.Sync(gommap.MS_SYNC); err != nil {
+			return err
+		}
+	}
+	err := i.mmap.UnsafeUnmap()
+	i.mmap = nil
+	return err
+}
+
+// seal
+// shrinks the file to the entries written and maps it read-only once the segment is closed for appends,
+// so closed segments take up neither the preallocated bytes on disk nor a writable mapping.
+// Readers of the index must be kept out while it is remapped.
+func (i *index) seal() error {
+	if !i.writable {
+		return nil
+	}
+	if err := i.unmap(); err != nil {
+		return err
+	}
+	return i.mapFile(i.size.Load(), false)
+}
+
+// unseal grows the file back to maxBytes and maps it read-write, for a closed segment to take appends again.
+func (i *index) unseal(maxBytes uint64) error {
+	if i.writable {
+		return nil
+	}
+	if err := i.unmap(); err != nil {
+		return err
+	}
+	return i.mapFile(maxBytes, true)
+}
+
+func (i *index) Close() error {
+	if err := i.unmap(); err != nil {
 		return err
 	}
+	// a file mapped read-only is already sized to its entries, see seal
+	if !i.writable {
+		return i.file.Close()
+	}
 	// Flush the file from the memory
 	if err := i.file.Sync(); err != nil {
 		return err
@@ -51,7 +141,7 @@ func (i *index) Close() error {
 	// Truncate it back to the size of the content of the file.
 	// Remove the extra empty bytes added at the end of the file.
 	// The last entWidth bytes should be the last record in the index
-	if err := i.file.Truncate(int64(i.size)); err != nil {
+	if err := i.file.Truncate(int64(i.start + i.size.Load())); err != nil {
 		return err
 	}
 	return i.file.Close()
@@ -62,37 +152,85 @@ func (i *index) Read(idx int64) (offset uint32, pos uint64, err error) {
 	// Calculate position of the record first, if idx < 0 is passed get the last entry.
 	// index are 0 indexed relative to the segment base for 32 bits. Getting 2^32 entries. i.e. 1 B entries per index.
 	// Along with the index value there are 8 bytes for the position of the record data in the store.
-	if i.size == 0 {
+	size := i.size.Load()
+	if size == 0 {
 		return 0, 0, io.EOF
 	}
 	if idx < 0 {
-		offset = uint32(i.size/entWidth) - 1
+		offset = uint32(size/entWidth) - 1
 	} else {
 		offset = uint32(idx)
 	}
 	// pos is index of the entry times the size of each entry.
 	pos = uint64(offset) * entWidth
 	// Check if there are enough bytes for the entry.
-	if i.size < pos+entWidth {
+	if size < pos+entWidth {
 		return 0, 0, io.EOF
 	}
 	// Get the bytes and decode the bytes to the offset and position.
+	pos += i.start
 	offset = enc.Uint32(i.mmap[pos : pos+offWidth])
 	pos = enc.Uint64(i.mmap[pos+offWidth : pos+entWidth])
 	return offset, pos, nil
 }
 
+// Search
+// returns the entry for the relative offset, or the entry after it when the offset has been compacted away.
+// io.EOF is returned if there are no entries from offset onwards.
+func (i *index) Search(offset uint32) (int64, error) {
+	n := int64(i.size.Load() / entWidth)
+	// Until a segment is compacted entry k holds offset k.
+	if int64(offset) < n {
+		if off, _, err := i.Read(int64(offset)); err == nil && off == offset {
+			return int64(offset), nil
+		}
+	}
+	// Otherwise binary search the entries, their offsets are increasing.
+	lo, hi := int64(0), n
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		off, _, err := i.Read(mid)
+		if err != nil {
+			return 0, err
+		}
+		if off < offset {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	if lo == n {
+		return 0, io.EOF
+	}
+	return lo, nil
+}
+
 // Append the pos to the index at the end of the file.
 func (i *index) Write(offset uint32, pos uint64) error {
-	if uint64(len(i.mmap)) < i.size+entWidth {
+	at := i.start + i.size.Load()
+	if uint64(len(i.mmap)) < at+entWidth {
 		return io.EOF
 	}
-	enc.PutUint32(i.mmap[i.size:i.size+offWidth], offset)
-	enc.PutUint64(i.mmap[i.size+offWidth:i.size+entWidth], pos)
-	i.size += entWidth
+	enc.PutUint32(i.mmap[at:at+offWidth], offset)
+	enc.PutUint64(i.mmap[at+offWidth:at+entWidth], pos)
+	// the entry is written before readers can see it
+	i.size.Add(entWidth)
 	return nil
 }
 
 func (i *index) Name() string {
 	return i.file.Name()
 }
+
+// truncate drops every entry after the first n entries.
+// The dropped entries are zeroed so they can't be mistaken for valid ones if the index isn't closed cleanly.
+func (i *index) truncate(n uint64) {
+	size := i.size.Load()
+	if n*entWidth >= size {
+		return
+	}
+	i.size.Store(n * entWidth)
+	for j := i.start + n*entWidth; j < i.start+size; j++ {
+		i.mmap[j] = 0
+	}
+}
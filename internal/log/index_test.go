@@ -12,7 +12,7 @@ func TestIndex(t *testing.T) {
 	assert.Nil(t, err, "error creating test file")
 	c := Config{}
 	c.Segment.MaxIndexBytes = 1024
-	i, err := newIndex(file, c)
+	i, err := newIndex(file, 0, c)
 	assert.Nil(t, err, "error creating new index")
 	assert.Equal(t, file.Name(), i.Name(), "index name is not same as file")
 
@@ -53,9 +53,38 @@ func TestIndex(t *testing.T) {
 
 	// Create index again with the same file
 	file, _ = os.OpenFile(file.Name(), os.O_RDWR, 0600)
-	i, err = newIndex(file, c)
+	i, err = newIndex(file, 0, c)
 	off, pos, err := i.Read(-1)
 	assert.Nil(t, err, "error received from reading from index")
 	assert.Equal(t, entries[1].off, off, "last offset entry doesn't match")
 	assert.Equal(t, entries[1].pos, pos, "last position entry doesn't match")
 }
+
+func TestIndexSeal(t *testing.T) {
+	file, err := os.CreateTemp("", "index_seal_test")
+	assert.Nil(t, err, "error creating test file")
+	defer os.Remove(file.Name())
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	i, err := newIndex(file, 0, c)
+	assert.Nil(t, err, "error creating new index")
+	assert.Nil(t, i.Write(0, headerWidth), "error writing entry")
+
+	// a sealed index only takes up its entries and doesn't take writes
+	assert.Nil(t, i.seal(), "error sealing index")
+	fi, err := file.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(headerWidth+entWidth), fi.Size(), "sealed index isn't shrunk")
+	assert.Equal(t, io.EOF, i.Write(1, headerWidth+10), "sealed index takes writes")
+	off, pos, err := i.Read(-1)
+	assert.Nil(t, err, "error reading sealed index")
+	assert.Equal(t, uint32(0), off)
+	assert.Equal(t, uint64(headerWidth), pos)
+
+	assert.Nil(t, i.unseal(c.Segment.MaxIndexBytes), "error unsealing index")
+	fi, err = file.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(headerWidth+c.Segment.MaxIndexBytes), fi.Size(), "unsealed index isn't preallocated")
+	assert.Nil(t, i.Write(1, headerWidth+10), "error writing entry to unsealed index")
+	assert.Nil(t, i.Close(), "error closing index")
+}
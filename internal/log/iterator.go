@@ -0,0 +1,68 @@
+package log
+
+import (
+	"errors"
+	api "github.com/adityavit/dslog/api/v1"
+	"io"
+)
+
+// ResetPolicy decides where an Iterator goes on from once the offset it is at has been truncated.
+type ResetPolicy int
+
+const (
+	// ResetNone returns the ErrOffsetOutOfRange to the caller.
+	ResetNone ResetPolicy = iota
+	// ResetEarliest goes on from the lowest offset of the log.
+	ResetEarliest
+	// ResetLatest goes on from the offset the next record appended gets.
+	ResetLatest
+)
+
+// Iterator
+// reads the records of a log in order, skipping the ones compacted away or expired.
+// It isn't safe for concurrent use.
+type Iterator struct {
+	log    *Log
+	offset uint64
+	reset  ResetPolicy
+}
+
+// Iterator returns an iterator reading from offset, resetting with reset if the offset gets truncated.
+func (l *Log) Iterator(offset uint64, reset ResetPolicy) *Iterator {
+	return &Iterator{log: l, offset: offset, reset: reset}
+}
+
+// Next returns the next record, io.EOF is returned once every record has been read until more are appended.
+func (it *Iterator) Next() (*api.Record, error) {
+	r, err := it.log.Read(it.offset)
+	var outOfRange ErrOffsetOutOfRange
+	if errors.As(err, &outOfRange) {
+		switch {
+		case !errors.Is(err, ErrOffsetTruncated):
+			return nil, io.EOF
+		case it.reset == ResetEarliest:
+			it.offset = outOfRange.Lowest
+			return it.Next()
+		case it.reset == ResetLatest:
+			it.offset = it.log.nextOffset()
+			return nil, io.EOF
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	it.offset = r.Offset + 1
+	return r, nil
+}
+
+// Offset returns the offset the iterator reads from next.
+func (it *Iterator) Offset() uint64 {
+	return it.offset
+}
+
+// nextOffset returns the offset the next record appended gets.
+func (l *Log) nextOffset() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.activeSegment.nextOffset
+}
@@ -0,0 +1,34 @@
+package log
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+)
+
+func TestIterator(t *testing.T) {
+	l := newRetentionLog(t, Config{})
+	it := l.Iterator(0, ResetNone)
+	for off := uint64(0); off < 7; off++ {
+		r, err := it.Next()
+		assert.NoError(t, err, "error iterating")
+		assert.Equal(t, off, r.Offset, "unexpected record")
+	}
+	_, err := it.Next()
+	assert.Equal(t, io.EOF, err, "iterator doesn't end")
+
+	assert.NoError(t, l.Truncate(3), "error truncating log")
+	_, err = l.Iterator(1, ResetNone).Next()
+	assert.True(t, errors.Is(err, ErrOffsetTruncated), "truncated offset is read")
+
+	it = l.Iterator(1, ResetEarliest)
+	r, err := it.Next()
+	assert.NoError(t, err, "error iterating")
+	assert.Equal(t, uint64(4), r.Offset, "iterator doesn't reset to the earliest offset")
+
+	it = l.Iterator(1, ResetLatest)
+	_, err = it.Next()
+	assert.Equal(t, io.EOF, err, "iterator doesn't reset to the latest offset")
+	assert.Equal(t, uint64(7), it.Offset(), "iterator doesn't reset to the latest offset")
+}
@@ -1,15 +1,16 @@
 package log
 
 import (
+	"errors"
 	"fmt"
 	api "github.com/adityavit/dslog/api/v1"
 	"io"
 	"os"
 	"path"
 	"sort"
-	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Log struct {
@@ -18,95 +19,355 @@ type Log struct {
 	Config        Config
 	activeSegment *segment
 	segments      []*segment
+	recovered     []SegmentRecovery
+	lastAppend    int64 // append time given to the last record, append times never go backwards
+	snapshot      atomic.Pointer[[]*segment]
+	cache         *segmentCache // closed segments with their files open
+
+	bg       *background
+	unsynced atomic.Uint64 // records appended since the last background sync
+	syncc    chan struct{} // wakes the background flusher up
+	errMu    sync.Mutex
+	bgErr    error
+	maintErr error
+	maintMu  sync.Mutex // serializes the maintenance tasks deleting or rewriting closed segments
+	holdMu   sync.Mutex
+	holds    []Hold // segments covered by a hold are never deleted
+
+	groupMu    sync.Mutex
+	pending    []*appendReq // appends waiting for the next group
+	committing bool         // a group is being committed
 }
 
 func newLog(dir string, c Config) (*Log, error) {
+	// checked before any file is created, the codec is only used once a new segment is
+	if c.Segment.Codec > CodecZlib {
+		return nil, fmt.Errorf("unsupported codec %d", c.Segment.Codec)
+	}
 	if c.Segment.MaxStoreBytes == 0 {
 		c.Segment.MaxStoreBytes = 1024
 	}
 	if c.Segment.MaxIndexBytes == 0 {
 		c.Segment.MaxIndexBytes = 1024
 	}
+	if c.Segment.TimeIndexInterval == 0 {
+		c.Segment.TimeIndexInterval = 64
+	}
+	if c.Retention.CheckInterval == 0 {
+		c.Retention.CheckInterval = time.Minute
+	}
+	if c.Compaction.Interval == 0 {
+		c.Compaction.Interval = time.Minute
+	}
+	if c.Merge.Interval == 0 {
+		c.Merge.Interval = time.Minute
+	}
+	if c.Compaction.DeleteRetention == 0 {
+		c.Compaction.DeleteRetention = 24 * time.Hour
+	}
+	if c.Durability.Mode == DurabilityInterval && c.Durability.SyncRecords == 0 && c.Durability.SyncInterval == 0 {
+		c.Durability.SyncInterval = time.Second
+	}
 	l := &Log{
 		Dir:    dir,
 		Config: c,
+		syncc:  make(chan struct{}, 1),
+		cache:  newSegmentCache(c.Segment.MaxOpenSegments),
 	}
 	return l, l.Setup()
 }
 
+// Setup
+// opens the segments listed in the manifest, reconciling it with the segment files in the directory,
+// and writes the manifest back with what was opened.
 func (l *Log) Setup() error {
-	entries, err := os.ReadDir(l.Dir)
+	if err := os.MkdirAll(l.Dir, 0755); err != nil {
+		return err
+	}
+	l.segments, l.activeSegment, l.recovered, l.lastAppend = nil, nil, nil, 0
+	holds, err := readHolds(l.Dir)
 	if err != nil {
 		return err
 	}
-	var baseOffsets []uint64
-	// Take the name of each of the file and then append it to the baseOffsets
-	for _, entry := range entries {
-		if !entry.IsDir() && strings.HasSuffix(entry.Name(), indexExt) {
-			offStr := strings.TrimSuffix(path.Base(entry.Name()), indexExt)
-			off, _ := strconv.ParseUint(offStr, 10, 0)
-			baseOffsets = append(baseOffsets, off)
+	l.holdMu.Lock()
+	l.holds = holds
+	l.holdMu.Unlock()
+	m, err := ReadManifest(l.Dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err = finishMerge(l.Dir, m); err != nil {
+		return err
+	}
+	if err = finishTruncate(l.Dir, m); err != nil {
+		return err
+	}
+	// a compaction or merge which didn't get to swap its segments in is dropped
+	if err := os.RemoveAll(path.Join(l.Dir, cleanerDir)); err != nil {
+		return err
+	}
+	files, err := segmentFiles(l.Dir)
+	if err != nil {
+		return err
+	}
+	baseOffsets, stale, err := reconcile(l.Dir, m, files)
+	if err != nil {
+		return err
+	}
+	for _, off := range stale {
+		if err := removeSegmentFiles(l.Dir, off); err != nil {
+			return err
 		}
 	}
-	sort.Slice(baseOffsets, func(i, j int) bool {
-		return baseOffsets[i] < baseOffsets[j]
-	})
-	for _, off := range baseOffsets {
-		if err := l.newSegment(off); err != nil {
+	// closed segments the manifest knows enough about are only opened once they are read, unless their files
+	// don't add up to what it recorded, as when an index is missing, then they are opened and repaired now
+	known := make(map[uint64]ManifestSegment)
+	if m != nil {
+		for _, ms := range m.Segments {
+			if ms.State == SegmentClosed && ms.Size > 0 {
+				known[ms.BaseOffset] = ms
+			}
+		}
+	}
+	for i, off := range baseOffsets {
+		if ms, ok := known[off]; ok && i < len(baseOffsets)-1 && sealedSize(l.Dir, off) == ms.Size {
+			s := closedSegment(l.Dir, ms, l.Config)
+			s.cache, s.evictable = l.cache, true
+			l.segments = append(l.segments, s)
+			continue
+		}
+		if err := l.openSegment(off); err != nil {
+			return err
+		}
+	}
+	if m != nil && m.TruncateAfter != nil {
+		if err := l.truncateSegments(*m.TruncateAfter); err != nil {
 			return err
 		}
 	}
 	if len(l.segments) == 0 {
-		if err := l.newSegment(l.Config.Segment.InitialOffset); err != nil {
+		if err := l.openSegment(l.Config.Segment.InitialOffset); err != nil {
 			return err
 		}
 	}
+	if err := l.upgradeActive(); err != nil {
+		return err
+	}
+	for _, seg := range l.segments {
+		if seg.maxTime > l.lastAppend {
+			l.lastAppend = seg.maxTime
+		}
+	}
+	l.checkManifest(m)
+	if err := l.writeManifest(); err != nil {
+		return err
+	}
+	l.startBackground()
 	return nil
 }
 
+// startBackground starts the goroutines the configuration asks for, Close stops them.
+func (l *Log) startBackground() {
+	l.bg = newBackground()
+	if l.Config.Durability.Mode == DurabilityInterval {
+		l.bg.run(l.Config.Durability.SyncInterval, l.syncc, l.syncActive)
+	}
+	// the janitor always runs, records can expire whatever the retention limits are
+	l.bg.run(l.Config.Retention.CheckInterval, nil, l.maintain(func() error {
+		return l.applyRetention(time.Now())
+	}))
+	if age := l.Config.Segment.MaxSegmentAge; age > 0 {
+		l.bg.run(age/10, nil, l.maintain(func() error {
+			return l.rollAged(time.Now())
+		}))
+	}
+	if l.Config.Merge.Enabled {
+		l.bg.run(l.Config.Merge.Interval, nil, l.maintain(l.Merge))
+	}
+	if l.Config.Compaction.Enabled {
+		l.bg.run(l.Config.Compaction.Interval, nil, l.maintain(func() error {
+			return l.compact(time.Now())
+		}))
+	}
+}
+
+// Append
+// appends the record and returns its offset once it meets the durability mode of the log.
+// Concurrent appends are committed in groups, see groupAppend.
 func (l *Log) Append(record *api.Record) (uint64, error) {
-	l.mu.Lock()
-	defer l.mu.Unlock()
-	offset, err := l.activeSegment.Append(record)
-	if err != nil {
+	if err := validate(record); err != nil {
 		return 0, err
 	}
-	if l.activeSegment.IsMaxed() {
-		err = l.newSegment(offset + 1)
+	return l.groupAppend([]*api.Record{record})
+}
+
+// AppendBatch
+// appends the records with contiguous offsets and returns the offset of the first one.
+// Either all the records are appended or none are, readers never see part of a batch, and the batch is
+// written in one block so a crash doesn't leave part of it behind either.
+func (l *Log) AppendBatch(records []*api.Record) (uint64, error) {
+	if len(records) == 0 {
+		return 0, ErrEmptyBatch
+	}
+	// a batch has to fit in the index of a single segment
+	if uint64(len(records))*entWidth > l.Config.Segment.MaxIndexBytes {
+		return 0, ErrBatchTooLarge
 	}
-	return offset, err
+	for _, r := range records {
+		if err := validate(r); err != nil {
+			return 0, err
+		}
+	}
+	return l.groupAppend(records)
 }
 
+// validate checks the record can be appended.
+func validate(r *api.Record) error {
+	if r.Tombstone && (len(r.Key) == 0 || len(r.Value) > 0) {
+		return ErrInvalidTombstone
+	}
+	return nil
+}
+
+// Read
+// reads the record at offset. Records compacted away or expired are absent, the next record there is is read instead.
+// It doesn't take the lock of the log, the segment is looked up in the snapshot of the segments last published.
 func (l *Log) Read(offset uint64) (*api.Record, error) {
+	now := time.Now().UnixNano()
+	var rec *api.Record
+	err := l.read(offset, func(seg *segment, offset uint64) (uint64, bool, error) {
+		r, err := seg.readPublished(offset)
+		if err != nil {
+			return 0, false, err
+		}
+		rec = r
+		return r.Offset, expiresAt(r) > now, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// read reads offset with fn from the segments of the snapshot last published, see readSegments.
+func (l *Log) read(offset uint64, fn readFunc) error {
+	for {
+		snapshot := l.snapshot.Load()
+		err := readSegments(*snapshot, offset, fn)
+		// the segment was closed after the snapshot was taken, a newer one has been published since
+		if err != errSegmentClosed || l.snapshot.Load() == snapshot {
+			return err
+		}
+	}
+}
+
+// errSegmentClosed is returned by readSegments when a segment of the snapshot has been closed.
+var errSegmentClosed = errors.New("segment closed")
+
+// readFunc
+// reads the first published record at or after offset from a segment the caller holds a reference to.
+// It returns the offset of the record read and whether it is live, io.EOF if there is none.
+type readFunc func(seg *segment, offset uint64) (off uint64, live bool, err error)
+
+// readSegments
+// reads the first live record at or after offset in the segments, which are sorted by base offset, with read.
+// Expired records are passed over.
+func readSegments(segments []*segment, offset uint64, read readFunc) error {
+	requested := offset
+	// the last segment starting at or before the offset
+	i := sort.Search(len(segments), func(i int) bool {
+		return segments[i].baseOffset > offset
+	}) - 1
+	for i >= 0 && i < len(segments) {
+		seg := segments[i]
+		if err := seg.open(); err != nil {
+			return err
+		}
+		off, live, err := read(seg, offset)
+		// a segment the log let go of is closed by its last reader, there is nobody to tell if that fails
+		seg.release()
+		if err == io.EOF {
+			// the rest of the segment was compacted away or expired
+			if i++; i < len(segments) && segments[i].baseOffset > offset {
+				offset = segments[i].baseOffset
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if live {
+			return nil
+		}
+		offset = off + 1
+	}
+	outOfRange := ErrOffsetOutOfRange{Offset: requested}
+	if len(segments) > 0 {
+		outOfRange.Lowest = segments[0].baseOffset
+		if next := segments[len(segments)-1].published.Load(); next > 0 {
+			outOfRange.Highest = next - 1
+		}
+	}
+	return outOfRange
+}
+
+// OffsetForTime
+// returns the first offset appended at or after t. If every record is older, the offset the next record gets is returned.
+func (l *Log) OffsetForTime(t time.Time) (uint64, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
-	var s *segment
-	// find the segment in which the offset is present
+	ts := t.UnixNano()
 	for _, seg := range l.segments {
-		if seg.baseOffset <= offset && offset < seg.nextOffset {
-			s = seg
-			break
+		off, ok, err := seg.offsetForTime(ts)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			return off, nil
 		}
 	}
-	// If there is no segment found with the offset within the segment
-	if s == nil || s.nextOffset <= offset {
-		return nil, fmt.Errorf("log offset not found")
+	return l.activeSegment.nextOffset, nil
+}
+
+// appendTime returns the time to stamp appended records with, which is never before the last one.
+func (l *Log) appendTime() int64 {
+	now := time.Now().UnixNano()
+	if now < l.lastAppend {
+		return l.lastAppend
 	}
-	return s.Read(offset)
+	l.lastAppend = now
+	return now
 }
 
 func (l *Log) Close() error {
+	// the background goroutines take the lock themselves
+	if l.bg != nil {
+		l.bg.stop()
+		l.bg = nil
+	}
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if err := l.writeManifest(); err != nil {
+		return err
+	}
+	// readers find the log empty, segments being read are closed by their last reader
+	l.snapshot.Store(new([]*segment))
 	for _, seg := range l.segments {
-		if err := seg.Close(); err != nil {
+		if err := seg.drop(); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// Remove closes the log and removes its directory, ErrHeld is returned if there are holds on the log.
 func (l *Log) Remove() error {
+	l.maintMu.Lock()
+	held := len(l.holds) > 0
+	l.maintMu.Unlock()
+	if held {
+		return ErrHeld
+	}
 	if err := l.Close(); err != nil {
 		return err
 	}
@@ -123,73 +384,226 @@ func (l *Log) Reset() error {
 func (l *Log) LowestOffset() (uint64, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
+	return l.lowestOffset(), nil
+}
+
+func (l *Log) lowestOffset() uint64 {
 	if len(l.segments) > 0 {
-		return l.segments[0].baseOffset, nil
+		return l.segments[0].baseOffset
 	}
-	return l.Config.Segment.InitialOffset, nil
+	return l.Config.Segment.InitialOffset
 }
 
 func (l *Log) HighestOffset() (uint64, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
+	return l.highestOffset(), nil
+}
+
+func (l *Log) highestOffset() uint64 {
 	off := uint64(0)
 	if len(l.segments) > 0 {
 		off = l.segments[len(l.segments)-1].nextOffset
 	}
 	if off == 0 {
-		return 0, nil
+		return 0
 	}
-	return off - 1, nil
+	return off - 1
 }
 
 // Truncate removes all the segments from the log with last offset lower than the given offset
+// ErrHeld is returned without removing any if one of them is under a hold
 func (l *Log) Truncate(offset uint64) error {
+	l.maintMu.Lock()
+	defer l.maintMu.Unlock()
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	var segments []*segment
+	var segments, removed []*segment
 	for _, seg := range l.segments {
 		if seg.nextOffset <= offset+1 {
-			if err := seg.Remove(); err != nil {
-				return err
+			if l.held(seg) {
+				return ErrHeld
 			}
+			removed = append(removed, seg)
 			continue
 		}
 		segments = append(segments, seg)
 	}
-	l.segments = segments
+	return l.removeSegments(segments, removed)
+}
+
+// removeSegments
+// replaces the segments of the log with the ones kept and removes the others.
+// The manifest drops the segments before their files go, so a crash in between leaves only stale files.
+func (l *Log) removeSegments(kept, removed []*segment) error {
+	l.segments = kept
+	l.publishSegments()
+	if err := l.writeManifest(); err != nil {
+		return err
+	}
+	for _, seg := range removed {
+		if err := seg.Remove(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// newSegment rolls the log over to a new active segment starting at offset.
 func (l *Log) newSegment(offset uint64) error {
-	s, err := newSegment(l.Dir, offset, l.Config)
+	// the background flusher only syncs the active segment
+	if l.Config.Durability.Mode == DurabilityInterval {
+		l.unsynced.Store(0)
+		if err := l.activeSegment.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := l.openSegment(offset); err != nil {
+		return err
+	}
+	return l.writeManifest()
+}
+
+// rollAged rolls the log over if the active segment is older than MaxSegmentAge at now, even when nothing is appended.
+func (l *Log) rollAged(now time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.activeSegment.aged(now.UnixNano()) {
+		return nil
+	}
+	return l.newSegment(l.activeSegment.nextOffset)
+}
+
+// upgradeActive
+// makes new records go into a segment with the current format, older formats are only read.
+// An empty active segment is rewritten in the current format, otherwise a new one is rolled.
+func (l *Log) upgradeActive() error {
+	active := l.activeSegment
+	if active.store.header.Version == formatVersion {
+		return nil
+	}
+	if active.nextOffset > active.baseOffset {
+		return l.openSegment(active.nextOffset)
+	}
+	return active.store.upgrade(l.Config.Segment.Codec)
+}
+
+// openSegment opens the segment starting at offset and makes it the active one.
+func (l *Log) openSegment(offset uint64) error {
+	if l.activeSegment != nil {
+		if err := l.activeSegment.seal(); err != nil {
+			return err
+		}
+	}
+	s, err := l.loadSegment(offset)
 	if err != nil {
 		return err
 	}
 	l.segments = append(l.segments, s)
 	l.activeSegment = s
+	l.publishSegments()
 	return nil
 }
 
+// loadSegment opens the segment of the log starting at offset, whose files are kept open by the cache once it is sealed.
+func (l *Log) loadSegment(offset uint64) (*segment, error) {
+	s, err := newSegment(l.Dir, offset, l.Config)
+	if err != nil {
+		return nil, err
+	}
+	s.cache = l.cache
+	return s, nil
+}
+
+// publishSegments
+// publishes a snapshot of the segments for readers, it is called under the lock whenever they change.
+// Segments dropped from the log are only released after the snapshot without them is published.
+func (l *Log) publishSegments() {
+	segments := append([]*segment(nil), l.segments...)
+	l.snapshot.Store(&segments)
+}
+
+// Recovered returns the segments which had to be repaired when the log was set up.
+func (l *Log) Recovered() []SegmentRecovery {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.recovered
+}
+
+// writeManifest records the current segments of the log in its manifest.
+func (l *Log) writeManifest() error {
+	return writeManifest(l.Dir, l.manifest())
+}
+
+// manifest describes the current segments of the log.
+func (l *Log) manifest() *Manifest {
+	m := &Manifest{Version: manifestVersion}
+	for _, seg := range l.segments {
+		state := SegmentClosed
+		if seg == l.activeSegment {
+			state = SegmentActive
+		}
+		ms := ManifestSegment{
+			BaseOffset: seg.baseOffset,
+			NextOffset: seg.nextOffset,
+			State:      state,
+		}
+		if state == SegmentClosed {
+			ms.Size, ms.MaxTime = seg.size(), seg.maxTime
+		}
+		m.Segments = append(m.Segments, ms)
+	}
+	return m
+}
+
+// checkManifest
+// collects the repairs done to the segments while opening them. Closed segments which came up shorter than
+// the manifest recorded them are reported as well, those records are gone for good.
+func (l *Log) checkManifest(m *Manifest) {
+	closed := make(map[uint64]uint64)
+	if m != nil {
+		for _, ms := range m.Segments {
+			if ms.State == SegmentClosed {
+				closed[ms.BaseOffset] = ms.NextOffset
+			}
+		}
+	}
+	for _, seg := range l.segments {
+		r := seg.recovery
+		if next, ok := closed[seg.baseOffset]; ok && seg.nextOffset+r.DiscardedRecords < next {
+			r.DiscardedRecords = next - seg.nextOffset
+		}
+		if r.Repaired() {
+			l.recovered = append(l.recovered, r)
+		}
+	}
+}
+
 func (l *Log) Reader() io.Reader {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 	readers := make([]io.Reader, len(l.segments))
 	for i, seg := range l.segments {
 		readers[i] = &originReader{
-			store: seg.store,
-			off:   0,
+			seg: seg,
+			off: 0,
 		}
 	}
 	return io.MultiReader(readers...)
 }
 
+// originReader reads the store of a segment from its start, opening the segment for every read.
 type originReader struct {
-	*store
+	seg *segment
 	off int64
 }
 
 func (r *originReader) Read(p []byte) (int, error) {
-	n, err := r.ReadAt(p, r.off)
+	if err := r.seg.open(); err != nil {
+		return 0, err
+	}
+	defer r.seg.release()
+	n, err := r.seg.store.ReadAt(p, r.off)
 	r.off += int64(n)
 	return n, err
 }
@@ -1,12 +1,17 @@
 package log
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	api "github.com/adityavit/dslog/api/v1"
 	"github.com/stretchr/testify/assert"
 	"google.golang.org/protobuf/proto"
 	"io"
 	"os"
+	"path"
 	"testing"
+	"time"
 )
 
 func TestLog(t *testing.T) {
@@ -16,6 +21,7 @@ func TestLog(t *testing.T) {
 		"init with existing segments":      testInitExisting,
 		"reader":                           testReader,
 		"truncate":                         testTruncate,
+		"record fields":                    testRecordFields,
 	}
 	c := Config{}
 	rec := &api.Record{
@@ -49,10 +55,44 @@ func testAppendRead(t *testing.T, log *Log) {
 	assert.Equal(t, rec.Value, actualRec.Value, "read record doesn't match stored record")
 }
 
+func testRecordFields(t *testing.T, log *Log) {
+	rec := api.Record{
+		Value:     []byte("hello world"),
+		Key:       []byte("greeting"),
+		Timestamp: 42,
+		Headers: []*api.Header{
+			{Key: "lang", Value: []byte("en")},
+			{Key: "lang", Value: []byte("fr")},
+		},
+	}
+	off, err := log.Append(&rec)
+	assert.NoError(t, err, "Error when appending record")
+	actualRec, err := log.Read(off)
+	assert.NoError(t, err, "Error when reading record")
+	assert.Equal(t, rec.Key, actualRec.Key, "key doesn't match stored record")
+	assert.Equal(t, rec.Timestamp, actualRec.Timestamp, "producer timestamp doesn't match stored record")
+	assert.NotZero(t, actualRec.AppendTime, "append time is not set")
+	assert.Len(t, actualRec.Headers, 2, "headers don't match stored record")
+	for i, h := range rec.Headers {
+		assert.Equal(t, h.Key, actualRec.Headers[i].Key, "header key doesn't match stored record")
+		assert.Equal(t, h.Value, actualRec.Headers[i].Value, "header value doesn't match stored record")
+	}
+}
+
 func testOutOfRangeErr(t *testing.T, log *Log) {
 	read, err := log.Read(uint64(1))
-	assert.Error(t, err, "error when reading the record")
+	assert.Equal(t, ErrOffsetOutOfRange{Offset: 1}, err, "unexpected error when reading the record")
 	assert.Nil(t, read, "read has data")
+	assert.False(t, errors.Is(err, ErrOffsetTruncated), "offset after the end is truncated")
+
+	for i := 0; i < 3; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		assert.NoError(t, err, "error appending record")
+	}
+	assert.NoError(t, log.Truncate(1), "error truncating log")
+	_, err = log.Read(0)
+	assert.Equal(t, ErrOffsetOutOfRange{Offset: 0, Lowest: 2, Highest: 2}, err, "unexpected error when reading the record")
+	assert.True(t, errors.Is(err, ErrOffsetTruncated), "offset before the start isn't truncated")
 }
 
 func testInitExisting(t *testing.T, log *Log) {
@@ -92,7 +132,11 @@ func testReader(t *testing.T, log *Log) {
 	data, err := io.ReadAll(reader)
 	assert.NoError(t, err, "Error when reading raw bytes from store")
 	record := &api.Record{}
-	err = proto.Unmarshal(data[lenWidth:], record)
+	// the first store starts with its header, followed by the block holding the record
+	size := enc.Uint64(data[headerWidth : headerWidth+lenWidth])
+	block, err := decodeBlock(data[headerWidth+frameWidth:headerWidth+frameWidth+size], headerWidth)
+	assert.NoError(t, err, "Error when decoding block")
+	err = proto.Unmarshal(block.record(data[headerWidth+frameWidth:], 0), record)
 	assert.NoError(t, err, "Error when unmarshalling record")
 	assert.Equal(t, rec.Value, record.Value, "read record doesn't match stored record")
 }
@@ -111,3 +155,197 @@ func testTruncate(t *testing.T, log *Log) {
 	_, err = log.Read(0)
 	assert.Error(t, err, "No error reading 0 record after truncating as 1")
 }
+
+func TestAppendBatch(t *testing.T) {
+	dir, err := os.MkdirTemp("", "append_batch_test")
+	assert.NoError(t, err, "error creating dir")
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 4096
+	c.Segment.MaxIndexBytes = entWidth * 4
+	c.Durability.Mode = DurabilityOS
+	log, err := newLog(dir, c)
+	assert.NoError(t, err, "error create new log")
+	defer log.Close()
+	batch := func(n int) []*api.Record {
+		var records []*api.Record
+		for i := 0; i < n; i++ {
+			records = append(records, &api.Record{Value: []byte("hello world")})
+		}
+		return records
+	}
+
+	_, err = log.AppendBatch(nil)
+	assert.Equal(t, ErrEmptyBatch, err, "empty batch is accepted")
+	_, err = log.AppendBatch(batch(5))
+	assert.Equal(t, ErrBatchTooLarge, err, "batch larger than a segment is accepted")
+
+	off, err := log.AppendBatch(batch(3))
+	assert.NoError(t, err, "error appending batch")
+	assert.Equal(t, uint64(0), off, "first batch doesn't start at 0")
+	// only one entry is left in the active segment, the next batch goes into a new segment whole
+	off, err = log.AppendBatch(batch(2))
+	assert.NoError(t, err, "error appending batch")
+	assert.Equal(t, uint64(3), off, "batch offsets are not contiguous")
+	assert.Len(t, log.segments, 2, "batch is not moved to a new segment")
+	assert.Equal(t, uint64(3), log.activeSegment.baseOffset, "batch is split across segments")
+	for i := uint64(0); i < 5; i++ {
+		rec, err := log.Read(i)
+		assert.NoError(t, err, "error reading batch record")
+		assert.Equal(t, i, rec.Offset, "batch record read from the wrong offset")
+	}
+
+	// none of a batch whose commit failed is readable, not even once a later batch is committed
+	store := log.activeSegment.store
+	f := store.File
+	store.File, err = os.Open(f.Name())
+	assert.NoError(t, err, "error opening store")
+	_, err = log.AppendBatch(batch(2))
+	assert.Error(t, err, "failed batch is acknowledged")
+	assert.NoError(t, store.File.Close())
+	store.File = f
+	off, err = log.AppendBatch(batch(1))
+	assert.NoError(t, err, "error appending batch")
+	assert.Equal(t, uint64(5), off, "offsets of the failed batch aren't reused")
+	_, err = log.Read(6)
+	assert.Error(t, err, "record of the failed batch is read")
+}
+
+func TestAppendBatchCrash(t *testing.T) {
+	dir, err := os.MkdirTemp("", "append_batch_test")
+	assert.NoError(t, err, "error creating dir")
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1 << 20
+	c.Segment.MaxIndexBytes = 1 << 20
+	c.Durability.Mode = DurabilityOS
+	log, err := newLog(dir, c)
+	assert.NoError(t, err, "error create new log")
+	defer log.Close()
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	assert.NoError(t, err, "error appending record")
+	var records []*api.Record
+	for i := 0; i < 100; i++ {
+		records = append(records, &api.Record{Value: bytes.Repeat([]byte{byte(i)}, 100)})
+	}
+	_, err = log.AppendBatch(records)
+	assert.NoError(t, err, "error appending batch")
+
+	// crash: only part of the batch made it to the store, copy the log without closing it
+	crashed, err := os.MkdirTemp("", "append_batch_test")
+	assert.NoError(t, err, "error creating dir")
+	defer os.RemoveAll(crashed)
+	files, err := os.ReadDir(dir)
+	assert.NoError(t, err, "error reading dir")
+	for _, f := range files {
+		b, err := os.ReadFile(path.Join(dir, f.Name()))
+		assert.NoError(t, err, "error reading file")
+		if f.Name() == fmt.Sprintf("0%s", storeExt) {
+			b = b[:len(b)-len(b)/3]
+		}
+		assert.NoError(t, os.WriteFile(path.Join(crashed, f.Name()), b, 0644))
+	}
+
+	l, err := newLog(crashed, c)
+	assert.NoError(t, err, "error reopening log")
+	defer l.Close()
+	off, err := l.HighestOffset()
+	assert.NoError(t, err, "error reading highest offset")
+	assert.Equal(t, uint64(0), off, "part of the batch is kept")
+	_, err = l.Read(1)
+	assert.Error(t, err, "record of the torn batch is read")
+	recovered := l.Recovered()
+	if assert.Len(t, recovered, 1, "torn batch isn't repaired") {
+		assert.Equal(t, uint64(100), recovered[0].DiscardedRecords, "batch isn't discarded whole")
+		assert.NotZero(t, recovered[0].DiscardedBytes, "torn batch is left in the store")
+	}
+	off, err = l.Append(&api.Record{Value: []byte("hello world")})
+	assert.NoError(t, err, "error appending after repair")
+	assert.Equal(t, uint64(1), off, "append doesn't reuse the offsets of the torn batch")
+}
+
+func TestRoll(t *testing.T) {
+	dir, err := os.MkdirTemp("", "roll_test")
+	assert.NoError(t, err, "error creating dir")
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1 << 20
+	c.Segment.MaxIndexBytes = 1 << 20
+	c.Segment.MaxRecords = 3
+	c.Segment.MaxSegmentAge = time.Hour
+	log, err := newLog(dir, c)
+	assert.NoError(t, err, "error creating log")
+	defer log.Close()
+
+	// a batch never goes over the max records of the segment it is appended to
+	_, err = log.AppendBatch([]*api.Record{{Value: []byte("a")}, {Value: []byte("b")}})
+	assert.NoError(t, err, "error appending batch")
+	off, err := log.AppendBatch([]*api.Record{{Value: []byte("c")}, {Value: []byte("d")}})
+	assert.NoError(t, err, "error appending batch")
+	assert.Equal(t, uint64(2), off, "unexpected offset of batch")
+	assert.Equal(t, uint64(2), log.activeSegment.baseOffset, "segment goes over max records")
+	_, err = log.Append(&api.Record{Value: []byte("e")})
+	assert.NoError(t, err, "error appending record")
+	assert.Equal(t, uint64(5), log.activeSegment.baseOffset, "full segment isn't rolled")
+
+	// empty segments aren't rolled however old they get
+	assert.NoError(t, log.rollAged(time.Now().Add(2*time.Hour)), "error rolling log")
+	assert.Equal(t, uint64(5), log.activeSegment.baseOffset, "empty segment is rolled")
+	_, err = log.Append(&api.Record{Value: []byte("f")})
+	assert.NoError(t, err, "error appending record")
+	assert.NoError(t, log.rollAged(time.Now()), "error rolling log")
+	assert.Equal(t, uint64(5), log.activeSegment.baseOffset, "segment is rolled before it is old")
+	assert.NoError(t, log.rollAged(time.Now().Add(2*time.Hour)), "error rolling log")
+	assert.Equal(t, uint64(6), log.activeSegment.baseOffset, "old segment isn't rolled")
+
+	// appending rolls an old segment before the record goes in
+	_, err = log.Append(&api.Record{Value: []byte("g")})
+	assert.NoError(t, err, "error appending record")
+	log.lastAppend = time.Now().Add(2 * time.Hour).UnixNano()
+	off, err = log.Append(&api.Record{Value: []byte("h")})
+	assert.NoError(t, err, "error appending record")
+	assert.Equal(t, off, log.activeSegment.baseOffset, "old segment isn't rolled on append")
+}
+
+func TestReadConcurrent(t *testing.T) {
+	l := newRetentionLog(t, Config{})
+	// a reader holding a segment keeps reading it after it is truncated
+	seg := l.segments[0]
+	assert.True(t, seg.acquire(), "segment can't be acquired")
+	assert.NoError(t, l.Truncate(1), "error truncating log")
+	r, err := seg.readPublished(1)
+	assert.NoError(t, err, "error reading truncated segment")
+	assert.Equal(t, uint64(1), r.Offset, "unexpected record read")
+	assert.NoError(t, seg.release(), "error releasing segment")
+	assert.False(t, seg.acquire(), "released segment isn't closed")
+
+	// readers race appends, rolls and truncation
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			_, err := l.Append(&api.Record{Value: []byte("hello world")})
+			assert.NoError(t, err, "error appending record")
+			if i%20 == 0 {
+				hOffset, err := l.HighestOffset()
+				assert.NoError(t, err)
+				assert.NoError(t, l.Truncate(hOffset-4), "error truncating log")
+			}
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		hOffset, err := l.HighestOffset()
+		assert.NoError(t, err)
+		r, err := l.Read(hOffset)
+		if errors.Is(err, ErrOffsetTruncated) {
+			continue
+		}
+		assert.NoError(t, err, "error reading record")
+		assert.GreaterOrEqual(t, r.Offset, hOffset, "unexpected record read")
+	}
+}
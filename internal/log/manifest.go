@@ -0,0 +1,186 @@
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	manifestFile    = "manifest.json"
+	manifestVersion = 1
+
+	SegmentActive = "active"
+	SegmentClosed = "closed"
+)
+
+// Manifest
+// lists the segments of a log directory, it is the authority on which segments make up the log.
+// It is rewritten atomically whenever segments are added or removed.
+type Manifest struct {
+	Version  int               `json:"version"`
+	Segments []ManifestSegment `json:"segments"`
+	// Merge is only set while the files of a merge are being swapped in.
+	Merge *ManifestMerge `json:"merge,omitempty"`
+	// TruncateAfter is only set while the records after it are being removed, see Log.TruncateAfter.
+	TruncateAfter *uint64 `json:"truncate_after,omitempty"`
+}
+
+// ManifestSegment
+// describes a segment in the manifest. NextOffset of the active segment is only as recent as the last
+// time the manifest was written. Closed segments also record their size and the append time of their
+// last record, which lets the log leave their files closed until they are read.
+type ManifestSegment struct {
+	BaseOffset uint64 `json:"base_offset"`
+	NextOffset uint64 `json:"next_offset"`
+	State      string `json:"state"`
+	Size       uint64 `json:"size,omitempty"`
+	MaxTime    int64  `json:"max_time,omitempty"`
+}
+
+// ManifestMerge
+// records the segments being merged into the one at BaseOffset, the first of them. The merged segment
+// is moved out of the cleaner directory and the others removed when the log is set up after a crash.
+// Created tells the store of the merged segment apart from the one of the first segment merged into it.
+type ManifestMerge struct {
+	BaseOffset uint64   `json:"base_offset"`
+	Merged     []uint64 `json:"merged"`
+	Created    int64    `json:"created,omitempty"`
+}
+
+// ReadManifest reads the manifest of the log in dir, os.ErrNotExist is returned if there is none.
+func ReadManifest(dir string) (*Manifest, error) {
+	b, err := os.ReadFile(path.Join(dir, manifestFile))
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	if err = json.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf("invalid manifest in %s: %w", dir, err)
+	}
+	if m.Version != manifestVersion {
+		return nil, fmt.Errorf("unsupported manifest version %d in %s", m.Version, dir)
+	}
+	return m, nil
+}
+
+// writeManifest
+// writes the manifest into a temporary file and renames it over the old one, so a crash leaves either
+// the old or the new manifest behind.
+func writeManifest(dir string, m *Manifest) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path.Join(dir, manifestFile), b)
+}
+
+// writeFileAtomic replaces name with data through a synced temporary file and a rename.
+func writeFileAtomic(name string, data []byte) error {
+	tmp := name + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, name); err != nil {
+		return err
+	}
+	// Sync the directory so the rename itself is durable.
+	return syncDir(path.Dir(name))
+}
+
+// syncDir makes the renames and removals done in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// segmentFiles
+// returns the base offsets of the segment files found in dir. Files which aren't named <base offset>.store
+// or <base offset>.index are not segment files and are ignored.
+func segmentFiles(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var baseOffsets []uint64
+	seen := make(map[uint64]bool)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		for _, ext := range []string{indexExt, storeExt} {
+			if !strings.HasSuffix(entry.Name(), ext) {
+				continue
+			}
+			off, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), ext), 10, 64)
+			if err != nil {
+				continue
+			}
+			if !seen[off] {
+				seen[off] = true
+				baseOffsets = append(baseOffsets, off)
+			}
+		}
+	}
+	sort.Slice(baseOffsets, func(i, j int) bool {
+		return baseOffsets[i] < baseOffsets[j]
+	})
+	return baseOffsets, nil
+}
+
+// reconcile
+// decides which segments to open from the manifest and the segment files found in the directory.
+// Segments created after the manifest was last written are newer than every listed segment and are kept,
+// unlisted files older than that were being removed when the log went down and are returned as stale.
+// A listed segment without a store means records were lost outside of the log, which is an error.
+func reconcile(dir string, m *Manifest, files []uint64) (open, stale []uint64, err error) {
+	if m == nil {
+		// No manifest yet, the directory is all there is.
+		return files, nil, nil
+	}
+	listed := make(map[uint64]bool)
+	var last uint64
+	for _, seg := range m.Segments {
+		if _, err := os.Stat(path.Join(dir, fmt.Sprintf("%d%s", seg.BaseOffset, storeExt))); err != nil {
+			return nil, nil, fmt.Errorf("segment %d in manifest: %w", seg.BaseOffset, err)
+		}
+		listed[seg.BaseOffset] = true
+		open = append(open, seg.BaseOffset)
+		if seg.BaseOffset > last {
+			last = seg.BaseOffset
+		}
+	}
+	for _, off := range files {
+		switch {
+		case listed[off]:
+		case len(m.Segments) > 0 && off < last:
+			stale = append(stale, off)
+		default:
+			open = append(open, off)
+		}
+	}
+	sort.Slice(open, func(i, j int) bool {
+		return open[i] < open[j]
+	})
+	return open, stale, nil
+}
@@ -0,0 +1,115 @@
+package log
+
+import (
+	"fmt"
+	api "github.com/adityavit/dslog/api/v1"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "manifest_test")
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = entWidth * 2
+	l, err := newLog(dir, c)
+	assert.NoError(t, err, "error creating log")
+	rec := &api.Record{Value: []byte("hello world")}
+	for i := 0; i < 5; i++ {
+		_, err = l.Append(rec)
+		assert.NoError(t, err, "error appending record")
+	}
+	m, err := ReadManifest(dir)
+	assert.NoError(t, err, "error reading manifest")
+	// closed segments record what they hold so they can be left unopened
+	for i := range m.Segments[:2] {
+		assert.Equal(t, l.segments[i].size(), m.Segments[i].Size, "manifest doesn't record the segment size")
+		assert.Equal(t, l.segments[i].maxTime, m.Segments[i].MaxTime, "manifest doesn't record the last append time")
+		m.Segments[i].Size, m.Segments[i].MaxTime = 0, 0
+	}
+	assert.Equal(t, []ManifestSegment{
+		{BaseOffset: 0, NextOffset: 2, State: SegmentClosed},
+		{BaseOffset: 2, NextOffset: 4, State: SegmentClosed},
+		{BaseOffset: 4, NextOffset: 4, State: SegmentActive},
+	}, m.Segments, "manifest doesn't list the segments")
+
+	err = l.Truncate(1)
+	assert.NoError(t, err, "error truncating log")
+	m, err = ReadManifest(dir)
+	assert.NoError(t, err, "error reading manifest")
+	assert.Equal(t, uint64(2), m.Segments[0].BaseOffset, "truncated segment is still in manifest")
+
+	assert.NoError(t, l.Close())
+	m, err = ReadManifest(dir)
+	assert.NoError(t, err, "error reading manifest")
+	assert.Equal(t, uint64(5), m.Segments[1].NextOffset, "closing doesn't record the active segment")
+}
+
+func TestManifestReconcile(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "manifest_reconcile_test")
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = entWidth * 2
+	l, err := newLog(dir, c)
+	assert.NoError(t, err, "error creating log")
+	rec := &api.Record{Value: []byte("hello world")}
+	for i := 0; i < 4; i++ {
+		_, err = l.Append(rec)
+		assert.NoError(t, err, "error appending record")
+	}
+	assert.NoError(t, l.Close())
+	m, err := ReadManifest(dir)
+	assert.NoError(t, err, "error reading manifest")
+
+	// stray files are not segments
+	for _, name := range []string{"foo.index", "foo.store", "1.2.index"} {
+		assert.NoError(t, os.WriteFile(path.Join(dir, name), nil, 0644))
+	}
+	// a segment left over from a truncate which crashed after writing the manifest
+	assert.NoError(t, writeManifest(dir, &Manifest{Version: manifestVersion, Segments: m.Segments[1:]}))
+	// a segment rolled after the manifest was last written
+	s, err := newSegment(dir, 4, c)
+	assert.NoError(t, err, "error creating segment")
+	_, err = s.Append(rec)
+	assert.NoError(t, err, "error appending record")
+	assert.NoError(t, s.Close())
+
+	l, err = newLog(dir, c)
+	assert.NoError(t, err, "error reopening log")
+	var bases []uint64
+	for _, seg := range l.segments {
+		bases = append(bases, seg.baseOffset)
+	}
+	assert.Equal(t, []uint64{2, 4}, bases, "segments are not reconciled")
+	_, err = os.Stat(path.Join(dir, fmt.Sprintf("%d%s", 0, storeExt)))
+	assert.True(t, os.IsNotExist(err), "stale segment is not removed")
+	hOffset, err := l.HighestOffset()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(4), hOffset, "unlisted newer segment is not adopted")
+	assert.NoError(t, l.Close())
+
+	// a listed segment without its store can't be opened
+	assert.NoError(t, os.Remove(path.Join(dir, fmt.Sprintf("%d%s", 2, storeExt))))
+	_, err = newLog(dir, c)
+	assert.Error(t, err, "missing store of a listed segment is not reported")
+}
+
+func TestLogReset(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "log_reset_test")
+	defer os.RemoveAll(dir)
+	c := Config{}
+	l, err := newLog(dir, c)
+	assert.NoError(t, err, "error creating log")
+	_, err = l.Append(&api.Record{Value: []byte("hello world")})
+	assert.NoError(t, err, "error appending record")
+	assert.NoError(t, l.Reset(), "error resetting log")
+	assert.Len(t, l.segments, 1, "reset log should have a single segment")
+	_, err = l.Read(0)
+	assert.Error(t, err, "record is still readable after reset")
+	_, err = ReadManifest(dir)
+	assert.NoError(t, err, "reset log has no manifest")
+}
@@ -0,0 +1,212 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"path"
+)
+
+// Merge
+// merges runs of adjacent closed segments which together fit in a single segment into one, keeping the offsets
+// of their records. It saves the files and index mappings of the many small segments restarts and rolling by age leave.
+func (l *Log) Merge() error {
+	l.maintMu.Lock()
+	defer l.maintMu.Unlock()
+	l.mu.RLock()
+	var closed []*segment
+	for _, seg := range l.segments {
+		if seg != l.activeSegment {
+			closed = append(closed, seg)
+		}
+	}
+	l.mu.RUnlock()
+	runs, err := mergeRuns(closed, l.Config)
+	if err != nil {
+		return err
+	}
+	for _, run := range runs {
+		if err := l.writeMerged(run); err != nil {
+			return err
+		}
+		if err := l.swapMerged(run); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeRuns returns the runs of two or more adjacent segments which fit in a single segment, taken greedily from the front.
+func mergeRuns(segments []*segment, c Config) ([][]*segment, error) {
+	var runs [][]*segment
+	var run []*segment
+	var size, records uint64
+	for _, seg := range segments {
+		if err := seg.open(); err != nil {
+			return nil, err
+		}
+		entries := seg.index.size.Load() / entWidth
+		// merged records are written in blocks, which take up no more room than framing them one by one did
+		bytes := seg.store.size - seg.store.header.start()
+		seg.release()
+		fits := headerWidth+size+bytes <= c.Segment.MaxStoreBytes &&
+			(records+entries)*entWidth <= c.Segment.MaxIndexBytes &&
+			(c.Segment.MaxRecords == 0 || records+entries <= c.Segment.MaxRecords)
+		if !fits {
+			if len(run) > 1 {
+				runs = append(runs, run)
+			}
+			run, size, records = nil, 0, 0
+		}
+		run = append(run, seg)
+		size += bytes
+		records += entries
+	}
+	if len(run) > 1 {
+		runs = append(runs, run)
+	}
+	return runs, nil
+}
+
+// writeMerged writes the records of the run into a segment in the cleaner directory.
+func (l *Log) writeMerged(run []*segment) error {
+	dir := path.Join(l.Dir, cleanerDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	merged, err := newSegment(dir, run[0].baseOffset, l.Config)
+	if err != nil {
+		return err
+	}
+	// closed segments are read without the lock, see Compact
+	for _, seg := range run {
+		if err = seg.each(merged.appendAt); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = merged.Close()
+	}
+	// the merged segment has to be on disk before the manifest records the merge, see swapMerged
+	if err == nil {
+		err = syncDir(dir)
+	}
+	if err == nil {
+		err = syncDir(l.Dir)
+	}
+	if err != nil {
+		removeSegmentFiles(dir, run[0].baseOffset)
+	}
+	return err
+}
+
+// swapMerged
+// replaces the run with the segment merged from it. The manifest records the merge before any file is touched,
+// from then on the merge is finished when the log is set up after a crash.
+func (l *Log) swapMerged(run []*segment) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	unpin, err := pinSegments(run)
+	if err != nil {
+		return err
+	}
+	defer unpin()
+	h, err := readHeader(segmentFile(path.Join(l.Dir, cleanerDir), run[0].baseOffset, storeExt))
+	if err != nil {
+		return err
+	}
+	m := l.manifest()
+	m.Merge = &ManifestMerge{BaseOffset: run[0].baseOffset, Created: h.CreatedAt}
+	for _, seg := range run {
+		m.Merge.Merged = append(m.Merge.Merged, seg.baseOffset)
+	}
+	if err := writeManifest(l.Dir, m); err != nil {
+		return err
+	}
+	// readers still holding the run keep reading its removed files until they release it
+	if err = finishMerge(l.Dir, m); err != nil {
+		return err
+	}
+	s, err := l.loadSegment(run[0].baseOffset)
+	if err != nil {
+		return err
+	}
+	if err = s.seal(); err != nil {
+		return err
+	}
+	var segments []*segment
+	for _, seg := range l.segments {
+		if seg == run[0] {
+			segments = append(segments, s)
+		}
+		if seg.baseOffset < run[0].baseOffset || seg.baseOffset > run[len(run)-1].baseOffset {
+			segments = append(segments, seg)
+		}
+	}
+	l.segments = segments
+	l.publishSegments()
+	for _, seg := range run {
+		if err := seg.drop(); err != nil {
+			return err
+		}
+	}
+	return l.writeManifest()
+}
+
+// finishMerge
+// moves the merged segment recorded in the manifest out of the cleaner directory, removes the segments merged
+// into it and drops them from the manifest. Nothing is done if no merge is recorded, and redoing it is safe.
+// If the merged segment is nowhere to be found, nothing is removed and an error is returned.
+func finishMerge(dir string, m *Manifest) error {
+	if m == nil || m.Merge == nil {
+		return nil
+	}
+	merge := m.Merge
+	// The segments merged are only removed once the merged store is found, moved already or not.
+	// The first of them has the same name, so a store in dir is only taken for it if it was created with it.
+	h, err := readHeader(segmentFile(path.Join(dir, cleanerDir), merge.BaseOffset, storeExt))
+	if os.IsNotExist(err) {
+		h, err = readHeader(segmentFile(dir, merge.BaseOffset, storeExt))
+		if err == nil && merge.Created != 0 && h.CreatedAt != merge.Created {
+			err = os.ErrNotExist
+		}
+		if err != nil {
+			return fmt.Errorf("segment %d merged from %v is missing: %w", merge.BaseOffset, merge.Merged, err)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	// the store is moved first, so whichever files are left in the cleaner directory still have to be
+	for _, ext := range []string{storeExt, indexExt, timeIndexExt} {
+		name := fmt.Sprintf("%d%s", merge.BaseOffset, ext)
+		err := os.Rename(path.Join(dir, cleanerDir, name), path.Join(dir, name))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	merged := make(map[uint64]bool)
+	for _, base := range merge.Merged[1:] {
+		if err := removeSegmentFiles(dir, base); err != nil {
+			return err
+		}
+		merged[base] = true
+	}
+	if err := syncDir(dir); err != nil {
+		return err
+	}
+	var segments []ManifestSegment
+	for _, ms := range m.Segments {
+		if !merged[ms.BaseOffset] {
+			segments = append(segments, ms)
+			continue
+		}
+		last := &segments[len(segments)-1]
+		if ms.NextOffset > last.NextOffset {
+			last.NextOffset = ms.NextOffset
+		}
+		// what the merged segment holds is only known once it is opened
+		last.Size, last.MaxTime = 0, 0
+	}
+	m.Segments, m.Merge = segments, nil
+	return nil
+}
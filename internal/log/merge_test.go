@@ -0,0 +1,106 @@
+package log
+
+import (
+	api "github.com/adityavit/dslog/api/v1"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path"
+	"testing"
+)
+
+// newMergeLog returns a log with segments 0-1, 2-3, 4-5 closed and 6 in the active segment,
+// reopened with segments taking five records.
+func newMergeLog(t *testing.T) *Log {
+	t.Helper()
+	l := newRetentionLog(t, Config{})
+	assert.NoError(t, l.Close(), "error closing log")
+	c := l.Config
+	c.Segment.MaxIndexBytes = entWidth * 5
+	l, err := newLog(l.Dir, c)
+	assert.NoError(t, err, "error reopening log")
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func checkMerged(t *testing.T, l *Log) {
+	t.Helper()
+	var bases []uint64
+	for _, seg := range l.segments {
+		bases = append(bases, seg.baseOffset)
+	}
+	assert.Equal(t, []uint64{0, 4, 6}, bases, "unexpected segments after merge")
+	for off := uint64(0); off < 7; off++ {
+		r, err := l.Read(off)
+		assert.NoError(t, err, "error reading record")
+		assert.Equal(t, off, r.Offset, "unexpected record read")
+	}
+	files, err := segmentFiles(l.Dir)
+	assert.NoError(t, err, "error listing segment files")
+	assert.Equal(t, bases, files, "merged segment files are left")
+	m, err := ReadManifest(l.Dir)
+	assert.NoError(t, err, "error reading manifest")
+	assert.Nil(t, m.Merge, "merge is left in the manifest")
+	assert.Len(t, m.Segments, 3, "manifest lists merged segments")
+	assert.Equal(t, uint64(4), m.Segments[0].NextOffset, "unexpected next offset of merged segment")
+}
+
+func TestMerge(t *testing.T) {
+	l := newMergeLog(t)
+	// 0-1 and 2-3 fit in one segment, 4-5 doesn't fit with them
+	assert.NoError(t, l.Merge(), "error merging segments")
+	checkMerged(t, l)
+	assert.NoError(t, l.Merge(), "error merging segments")
+	checkMerged(t, l)
+
+	_, err := l.Append(&api.Record{Value: []byte("hello world")})
+	assert.NoError(t, err, "error appending record")
+	assert.NoError(t, l.Close(), "error closing log")
+	l, err = newLog(l.Dir, l.Config)
+	assert.NoError(t, err, "error reopening log")
+	defer l.Close()
+	assert.Empty(t, l.Recovered(), "merged segments are repaired")
+	checkMerged(t, l)
+}
+
+func TestMergeCrash(t *testing.T) {
+	l := newMergeLog(t)
+	run := l.segments[:2]
+	assert.NoError(t, l.writeMerged(run), "error writing merged segment")
+	assert.NoError(t, l.Close(), "error closing log")
+
+	// crashed after the store of the merged segment was moved
+	m, err := ReadManifest(l.Dir)
+	assert.NoError(t, err, "error reading manifest")
+	h, err := readHeader(path.Join(l.Dir, cleanerDir, "0.store"))
+	assert.NoError(t, err, "error reading header of merged store")
+	m.Merge = &ManifestMerge{BaseOffset: 0, Merged: []uint64{0, 2}, Created: h.CreatedAt}
+	assert.NoError(t, writeManifest(l.Dir, m), "error writing manifest")
+	assert.NoError(t, os.Rename(path.Join(l.Dir, cleanerDir, "0.store"), path.Join(l.Dir, "0.store")))
+
+	l, err = newLog(l.Dir, l.Config)
+	assert.NoError(t, err, "error reopening log")
+	defer l.Close()
+	checkMerged(t, l)
+}
+
+func TestMergeLost(t *testing.T) {
+	l := newMergeLog(t)
+	run := l.segments[:2]
+	assert.NoError(t, l.writeMerged(run), "error writing merged segment")
+	assert.NoError(t, l.Close(), "error closing log")
+
+	// the merge is recorded, but the merged segment never made it to disk
+	h, err := readHeader(path.Join(l.Dir, cleanerDir, "0.store"))
+	assert.NoError(t, err, "error reading header of merged store")
+	m, err := ReadManifest(l.Dir)
+	assert.NoError(t, err, "error reading manifest")
+	m.Merge = &ManifestMerge{BaseOffset: 0, Merged: []uint64{0, 2}, Created: h.CreatedAt}
+	assert.NoError(t, writeManifest(l.Dir, m), "error writing manifest")
+	assert.NoError(t, os.RemoveAll(path.Join(l.Dir, cleanerDir)))
+
+	_, err = newLog(l.Dir, l.Config)
+	assert.Error(t, err, "merge is finished without the merged segment")
+	files, err := segmentFiles(l.Dir)
+	assert.NoError(t, err, "error listing segment files")
+	assert.Equal(t, []uint64{0, 2, 4, 6}, files, "segments merged are removed")
+}
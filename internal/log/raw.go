@@ -0,0 +1,82 @@
+package log
+
+import (
+	api "github.com/adityavit/dslog/api/v1"
+	"google.golang.org/protobuf/encoding/protowire"
+	"time"
+)
+
+// field numbers of api.Record in log.proto which are read without unmarshaling the record
+const (
+	offsetField     protowire.Number = 2
+	appendTimeField protowire.Number = 3
+	ttlField        protowire.Number = 8
+)
+
+// ReadRaw
+// reads the record at offset like Read, but returns it marshaled instead of unmarshaling it. The stores of closed
+// segments are memory mapped, and unless the log is compressed the bytes of their records point into the mapping
+// rather than being copied. b must not be modified, and release has to be called once b isn't used anymore:
+// the mapping is kept until then, and TruncateAfter waits for it before the segment of the record takes appends again.
+func (l *Log) ReadRaw(offset uint64) (b []byte, release func(), err error) {
+	now := time.Now().UnixNano()
+	err = l.read(offset, func(seg *segment, offset uint64) (uint64, bool, error) {
+		raw, aliased, off, expiry, err := seg.readPublishedRaw(offset)
+		if err != nil {
+			return 0, false, err
+		}
+		if expiry <= now {
+			if aliased {
+				seg.views.Done()
+			}
+			return off, false, nil
+		}
+		b, release = raw, func() {}
+		if aliased {
+			// the reference of the read is dropped once it returns, the record keeps one of its own
+			seg.acquire()
+			release = func() {
+				seg.views.Done()
+				seg.release()
+			}
+		}
+		return off, true, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return b, release, nil
+}
+
+// recordMeta returns the offset of the marshaled record and when it expires, without unmarshaling it.
+func recordMeta(b []byte) (offset uint64, expiry int64, err error) {
+	var r api.Record
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return 0, 0, protowire.ParseError(n)
+		}
+		b = b[n:]
+		if typ == protowire.VarintType && (num == offsetField || num == appendTimeField || num == ttlField) {
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return 0, 0, protowire.ParseError(n)
+			}
+			switch num {
+			case offsetField:
+				r.Offset = v
+			case appendTimeField:
+				r.AppendTime = int64(v)
+			case ttlField:
+				r.Ttl = int64(v)
+			}
+			b = b[n:]
+			continue
+		}
+		if n = protowire.ConsumeFieldValue(num, typ, b); n < 0 {
+			return 0, 0, protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return r.Offset, expiresAt(&r), nil
+}
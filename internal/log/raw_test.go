@@ -0,0 +1,102 @@
+package log
+
+import (
+	api "github.com/adityavit/dslog/api/v1"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"testing"
+	"time"
+)
+
+func TestReadRaw(t *testing.T) {
+	l := newRetentionLog(t, Config{})
+	for _, seg := range l.segments {
+		assert.Equal(t, seg != l.activeSegment, seg.store.mmap.Load() != nil, "only closed segments are mapped")
+		assert.Equal(t, seg == l.activeSegment, seg.index.writable, "only the active index is writable")
+	}
+	for off := uint64(0); off < 7; off++ {
+		b, release, err := l.ReadRaw(off)
+		assert.NoError(t, err, "error reading raw record")
+		rec := &api.Record{}
+		assert.NoError(t, proto.Unmarshal(b, rec), "error unmarshaling raw record")
+		assert.Equal(t, off, rec.Offset, "unexpected record read")
+		release()
+	}
+
+	// expired records are skipped like Read does
+	_, err := l.Append(&api.Record{Value: []byte("hello world"), Ttl: 1})
+	assert.NoError(t, err, "error appending record")
+	_, _, err = l.ReadRaw(7)
+	assert.Error(t, err, "expired record is read")
+
+	// truncating a segment waits for the records read from its mapping
+	b, release, err := l.ReadRaw(3)
+	assert.NoError(t, err, "error reading raw record")
+	truncated := make(chan error)
+	go func() { truncated <- l.TruncateAfter(2) }()
+	select {
+	case <-truncated:
+		t.Fatal("segment is truncated under a raw record")
+	case <-time.After(50 * time.Millisecond):
+	}
+	rec := &api.Record{}
+	assert.NoError(t, proto.Unmarshal(b, rec), "raw record changed before release")
+	assert.Equal(t, uint64(3), rec.Offset, "raw record changed before release")
+	release()
+	assert.NoError(t, <-truncated, "error truncating log")
+	assert.Nil(t, l.activeSegment.store.mmap.Load(), "active segment is still mapped")
+	assert.True(t, l.activeSegment.index.writable, "active index isn't writable")
+	_, err = l.Append(&api.Record{Value: []byte("hello world")})
+	assert.NoError(t, err, "error appending after truncation")
+}
+
+func TestReadRawDuringTruncate(t *testing.T) {
+	l := newRetentionLog(t, Config{})
+	seg := l.segments[0]
+	b, release, err := l.ReadRaw(0)
+	assert.NoError(t, err, "error reading raw record")
+	truncated := make(chan error)
+	go func() { truncated <- l.TruncateAfter(1) }()
+	assert.Eventually(t, func() bool {
+		seg.truncMu.RLock()
+		defer seg.truncMu.RUnlock()
+		return seg.unsealing
+	}, time.Second, time.Millisecond, "truncation doesn't wait for the raw record")
+
+	// the holder of a raw record reads the segment again before releasing it
+	read := make(chan error)
+	go func() {
+		_, release, err := l.ReadRaw(1)
+		if err == nil {
+			release()
+		}
+		_, err = l.Read(1)
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		assert.NoError(t, err, "error reading while truncation waits")
+	case <-time.After(time.Second):
+		t.Fatal("reads block while truncation waits for a raw record")
+	}
+	rec := &api.Record{}
+	assert.NoError(t, proto.Unmarshal(b, rec), "raw record changed before release")
+	assert.Equal(t, uint64(0), rec.Offset, "raw record changed before release")
+	release()
+	assert.NoError(t, <-truncated, "error truncating log")
+	off, err := l.Append(&api.Record{Value: []byte("hello world")})
+	assert.NoError(t, err, "error appending after truncation")
+	assert.Equal(t, uint64(2), off, "unexpected offset appended")
+}
+
+func TestReadRawCompressed(t *testing.T) {
+	c := Config{}
+	c.Segment.Codec = CodecGzip
+	l := newRetentionLog(t, c)
+	b, release, err := l.ReadRaw(1)
+	assert.NoError(t, err, "error reading raw record")
+	defer release()
+	rec := &api.Record{}
+	assert.NoError(t, proto.Unmarshal(b, rec), "raw record is still compressed")
+	assert.Equal(t, uint64(1), rec.Offset, "unexpected record read")
+}
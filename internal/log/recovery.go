@@ -0,0 +1,186 @@
+package log
+
+import (
+	"fmt"
+	api "github.com/adityavit/dslog/api/v1"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"os"
+	"path"
+)
+
+// SegmentRecovery
+// describes what was repaired in a segment when it was reopened after a crash or with a missing index
+type SegmentRecovery struct {
+	BaseOffset       uint64
+	DiscardedRecords uint64 // index entries whose record never made it to the store
+	DiscardedBytes   uint64 // trailing store bytes not belonging to an intact record
+	ReindexedRecords uint64 // records in the store which were missing from the index
+}
+
+// Discarded reports if anything was thrown away
+func (r SegmentRecovery) Discarded() bool {
+	return r.DiscardedRecords > 0 || r.DiscardedBytes > 0
+}
+
+// Repaired reports if the segment had to be changed at all
+func (r SegmentRecovery) Repaired() bool {
+	return r.Discarded() || r.ReindexedRecords > 0
+}
+
+// repair
+// cross-checks the index against the store and makes the index cover exactly the intact records of the store.
+// After a crash the index may still have its preallocated zero tail, or point at records that were
+// sitting in the store buffer and never reached the file, and the store may end with a partial record.
+// The index is derived from the store, so records found in the store past the last valid entry are indexed
+// again, which also rebuilds an index that is missing or damaged. What was repaired is returned.
+func (s *segment) repair() (SegmentRecovery, error) {
+	// The index entries are only ever appended, so the valid ones form a prefix with increasing offsets
+	// and positions, the records of a block share its position. Offsets have gaps in compacted segments,
+	// otherwise entry k holds relative offset k.
+	var entries int64
+	var prevOff uint32
+	var prevPos uint64
+	for ; uint64(entries+1)*entWidth <= s.index.size.Load(); entries++ {
+		off, pos, err := s.index.Read(entries)
+		if err != nil {
+			return SegmentRecovery{}, err
+		}
+		if pos < s.store.header.start() || (entries > 0 && (off <= prevOff || pos < prevPos)) {
+			break
+		}
+		prevOff, prevPos = off, pos
+	}
+	// Walk back from the last entry until the record it points to is fully in the store.
+	claimed := entries
+	end := s.store.header.start()
+	next := s.baseOffset
+	var missing []uint64 // offsets of the records of the last intact block past its last entry
+	for ; entries > 0; entries-- {
+		off, pos, err := s.index.Read(entries - 1)
+		if err != nil {
+			return SegmentRecovery{}, err
+		}
+		offsets, blockEnd, err := s.recordsAt(pos)
+		if err != nil && !isTorn(err) {
+			return SegmentRecovery{}, err
+		}
+		if err != nil {
+			continue
+		}
+		// a compaction which crashed while swapping files can leave the old index with the new store
+		k := len(offsets) - 1
+		for k >= 0 && offsets[k] != s.baseOffset+uint64(off) {
+			k--
+		}
+		if k >= 0 {
+			end, next = blockEnd, offsets[len(offsets)-1]+1
+			missing = offsets[k+1:]
+			break
+		}
+	}
+	s.index.truncate(uint64(entries))
+	kept := entries
+	// Index the intact records following the last indexed one, the store is cut at the first block which isn't.
+	var reindexed uint64
+	index := func(offsets []uint64, pos uint64) error {
+		for _, off := range offsets {
+			err := s.index.Write(uint32(off-s.baseOffset), pos)
+			if err == io.EOF {
+				return fmt.Errorf("index of segment %d is too small to cover its store", s.baseOffset)
+			}
+			if err != nil {
+				return err
+			}
+			entries++
+			reindexed++
+		}
+		return nil
+	}
+	if len(missing) > 0 {
+		_, pos, err := s.index.Read(entries - 1)
+		if err != nil {
+			return SegmentRecovery{}, err
+		}
+		if err = index(missing, pos); err != nil {
+			return SegmentRecovery{}, err
+		}
+	}
+	for end < s.store.size {
+		offsets, blockEnd, err := s.recordsAt(end)
+		if isTorn(err) || (err == nil && offsets[0] < next) {
+			break
+		}
+		if err != nil {
+			return SegmentRecovery{}, err
+		}
+		if err = index(offsets, end); err != nil {
+			return SegmentRecovery{}, err
+		}
+		end, next = blockEnd, offsets[len(offsets)-1]+1
+	}
+	recovery := SegmentRecovery{
+		BaseOffset:       s.baseOffset,
+		DiscardedRecords: uint64(claimed - kept),
+		DiscardedBytes:   s.store.size - end,
+		ReindexedRecords: reindexed,
+	}
+	if s.store.size > end {
+		return recovery, s.store.truncate(end)
+	}
+	return recovery, nil
+}
+
+// recordsAt
+// returns the offsets of the records in the block at pos, or of the single record stores of an older format
+// hold there, and where the block ends. ErrCorruptRecord is returned if they aren't fully and correctly there.
+func (s *segment) recordsAt(pos uint64) (offsets []uint64, end uint64, err error) {
+	b, err := s.store.Read(pos)
+	if err != nil {
+		return nil, 0, err
+	}
+	end = pos + s.store.frame + uint64(len(b))
+	if s.store.header.Version != formatVersion {
+		rec, err := s.decode(b)
+		if err != nil {
+			return nil, 0, ErrCorruptRecord{Pos: pos}
+		}
+		return []uint64{rec.Offset}, end, nil
+	}
+	d, err := decodeBlock(b, pos)
+	if err != nil {
+		return nil, 0, ErrCorruptRecord{Pos: pos}
+	}
+	for k := range d.spans {
+		rec := &api.Record{}
+		if err = proto.Unmarshal(d.record(b, k), rec); err != nil || (k > 0 && rec.Offset <= offsets[k-1]) {
+			return nil, 0, ErrCorruptRecord{Pos: pos}
+		}
+		offsets = append(offsets, rec.Offset)
+	}
+	return offsets, end, nil
+}
+
+// isTorn reports if a store read failed because the record isn't fully and correctly in the store.
+func isTorn(err error) bool {
+	_, corrupt := err.(ErrCorruptRecord)
+	return corrupt || err == io.EOF
+}
+
+// RebuildIndex
+// regenerates the index of the segment starting at baseOffset in dir by walking the records of its store.
+// The segment must not be open in a Log while its index is rebuilt.
+func RebuildIndex(dir string, baseOffset uint64, c Config) (SegmentRecovery, error) {
+	if _, err := os.Stat(path.Join(dir, fmt.Sprintf("%d%s", baseOffset, storeExt))); err != nil {
+		return SegmentRecovery{}, err
+	}
+	err := os.Remove(path.Join(dir, fmt.Sprintf("%d%s", baseOffset, indexExt)))
+	if err != nil && !os.IsNotExist(err) {
+		return SegmentRecovery{}, err
+	}
+	s, err := newSegment(dir, baseOffset, c)
+	if err != nil {
+		return SegmentRecovery{}, err
+	}
+	return s.recovery, s.Close()
+}
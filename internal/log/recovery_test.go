@@ -0,0 +1,139 @@
+package log
+
+import (
+	api "github.com/adityavit/dslog/api/v1"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestSegmentRepair(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "segment_repair_test")
+	defer os.RemoveAll(dir)
+	rec := &api.Record{Value: []byte("hello world")}
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	c.Segment.MaxStoreBytes = 1024
+	s, err := newSegment(dir, 16, c)
+	assert.NoError(t, err, "error creating segment")
+	for i := 0; i < 2; i++ {
+		_, err = s.Append(rec)
+		assert.NoError(t, err, "error appending the record to the segment")
+	}
+	assert.NoError(t, s.store.Flush(), "error flushing the store")
+	// the third record is indexed but never leaves the store buffer
+	_, err = s.Append(rec)
+	assert.NoError(t, err, "error appending the record to the segment")
+
+	// crash: reopen without closing, the index file still has its preallocated size
+	s, err = newSegment(dir, 16, c)
+	assert.NoError(t, err, "error reopening segment")
+	assert.Equal(t, uint64(18), s.nextOffset, "next offset should skip the lost record")
+	assert.Equal(t, SegmentRecovery{BaseOffset: 16, DiscardedRecords: 1}, s.recovery)
+	r, err := s.Read(17)
+	assert.NoError(t, err, "error reading last durable record")
+	assert.Equal(t, rec.Value, r.Value, "last durable record doesn't match")
+
+	// a partial record at the end of the store
+	size := s.store.size
+	_, err = s.store.Write([]byte{0, 0, 0})
+	assert.NoError(t, err, "error writing partial record")
+	s, err = newSegment(dir, 16, c)
+	assert.NoError(t, err, "error reopening segment")
+	assert.Equal(t, uint64(18), s.nextOffset, "next offset should not change")
+	assert.Equal(t, SegmentRecovery{BaseOffset: 16, DiscardedBytes: 3}, s.recovery)
+	assert.Equal(t, size, s.store.size, "partial record is not truncated")
+	off, err := s.Append(rec)
+	assert.NoError(t, err, "error appending after repair")
+	assert.Equal(t, uint64(18), off, "append doesn't reuse the discarded offset")
+	_, err = s.Read(off)
+	assert.NoError(t, err, "error reading record appended after repair")
+	assert.NoError(t, s.Close())
+}
+
+func TestRebuildIndex(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "rebuild_index_test")
+	defer os.RemoveAll(dir)
+	rec := &api.Record{Value: []byte("hello world")}
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	c.Segment.MaxStoreBytes = 1024
+	s, err := newSegment(dir, 16, c)
+	assert.NoError(t, err, "error creating segment")
+	for i := 0; i < 3; i++ {
+		_, err = s.Append(rec)
+		assert.NoError(t, err, "error appending the record to the segment")
+	}
+	assert.NoError(t, s.Close())
+
+	// damage the second index entry
+	f, err := os.OpenFile(s.index.Name(), os.O_WRONLY, 0644)
+	assert.NoError(t, err, "error opening index file")
+	_, err = f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, int64(entWidth))
+	assert.NoError(t, err, "error damaging index file")
+	assert.NoError(t, f.Close())
+
+	recovery, err := RebuildIndex(dir, 16, c)
+	assert.NoError(t, err, "error rebuilding index")
+	assert.Equal(t, SegmentRecovery{BaseOffset: 16, ReindexedRecords: 3}, recovery)
+	s, err = newSegment(dir, 16, c)
+	assert.NoError(t, err, "error reopening segment")
+	assert.False(t, s.recovery.Repaired(), "rebuilt index should not need repairs")
+	assert.Equal(t, uint64(19), s.nextOffset, "next offset doesn't cover the store")
+	for off := uint64(16); off < 19; off++ {
+		r, err := s.Read(off)
+		assert.NoError(t, err, "error reading record through rebuilt index")
+		assert.Equal(t, off, r.Offset, "record read from the wrong position")
+	}
+	assert.NoError(t, s.Close())
+
+	_, err = RebuildIndex(dir, 32, c)
+	assert.True(t, os.IsNotExist(err), "rebuilding a segment without store should fail")
+}
+
+func TestLogOrphanedStore(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "log_orphaned_store_test")
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	l, err := newLog(dir, c)
+	assert.NoError(t, err, "error creating log")
+	rec := &api.Record{Value: []byte("hello world")}
+	for i := 0; i < 3; i++ {
+		_, err = l.Append(rec)
+		assert.NoError(t, err, "error appending record")
+	}
+	assert.NoError(t, l.Close())
+	assert.NoError(t, os.Remove(l.activeSegment.index.Name()), "error removing index")
+
+	l, err = newLog(dir, c)
+	assert.NoError(t, err, "error reopening log")
+	assert.Equal(t, []SegmentRecovery{{BaseOffset: 0, ReindexedRecords: 3}}, l.Recovered())
+	hOffset, err := l.HighestOffset()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), hOffset, "records of the orphaned store are missing")
+	r, err := l.Read(2)
+	assert.NoError(t, err, "error reading record of the orphaned store")
+	assert.Equal(t, rec.Value, r.Value)
+}
+
+func TestLogMissingClosedIndex(t *testing.T) {
+	l := newRetentionLog(t, Config{})
+	assert.NoError(t, l.Close(), "error closing log")
+	assert.NoError(t, os.Remove(segmentFile(l.Dir, 0, indexExt)), "error removing index")
+
+	// the closed segment is rebuilt when the log is set up, not opened as sealed once it is read
+	l, err := newLog(l.Dir, l.Config)
+	assert.NoError(t, err, "error reopening log")
+	defer l.Close()
+	assert.Equal(t, []SegmentRecovery{{BaseOffset: 0, ReindexedRecords: 2}}, l.Recovered())
+	for off := uint64(0); off < 7; off++ {
+		r, err := l.Read(off)
+		assert.NoError(t, err, "error reading record")
+		assert.Equal(t, off, r.Offset, "unexpected record read")
+	}
+	m, err := ReadManifest(l.Dir)
+	assert.NoError(t, err, "error reading manifest")
+	assert.Equal(t, l.segments[0].fileSize(), m.Segments[0].Size, "manifest doesn't record the rebuilt segment")
+}
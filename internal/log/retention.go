@@ -0,0 +1,107 @@
+package log
+
+import (
+	api "github.com/adityavit/dslog/api/v1"
+	"math"
+	"os"
+	"time"
+)
+
+// applyRetention
+// deletes closed segments outside the retention policy or with all their records expired, oldest first, as of now.
+// Segments are only deleted from the front of the log, and neither the active segment nor held ones are.
+func (l *Log) applyRetention(now time.Time) error {
+	l.maintMu.Lock()
+	defer l.maintMu.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var total uint64
+	for _, seg := range l.segments {
+		total += seg.size()
+	}
+	retention := l.Config.Retention
+	n := 0
+	for ; n < len(l.segments) && l.segments[n] != l.activeSegment; n++ {
+		seg := l.segments[n]
+		if l.held(seg) {
+			break
+		}
+		tooOld := retention.MaxAge > 0 && now.Sub(seg.lastModified()) > retention.MaxAge
+		tooBig := retention.MaxBytes > 0 && total > retention.MaxBytes
+		expiry, err := seg.expiresAt()
+		if err != nil {
+			return err
+		}
+		if !tooOld && !tooBig && expiry > now.UnixNano() {
+			break
+		}
+		total -= seg.size()
+	}
+	if n == 0 {
+		return nil
+	}
+	removed := append([]*segment(nil), l.segments[:n]...)
+	return l.removeSegments(l.segments[n:], removed)
+}
+
+// size returns the bytes the segment takes up, not counting the preallocated part of the index.
+func (s *segment) size() uint64 {
+	if s.closedSize > 0 {
+		return s.closedSize
+	}
+	return s.fileSize()
+}
+
+// fileSize works out size from the files of the segment, which have to be open.
+func (s *segment) fileSize() uint64 {
+	return s.store.size +
+		s.index.start + s.index.size.Load() +
+		s.timeIndex.header.start() + uint64(len(s.timeIndex.entries))*timeEntryWidth
+}
+
+// lastModified
+// returns when the last record was appended to the segment. Empty segments use their creation time,
+// and segments written before headers and append times existed, or not opened, the modification time of the store.
+func (s *segment) lastModified() time.Time {
+	if s.maxTime > 0 {
+		return time.Unix(0, s.maxTime)
+	}
+	if !s.created.IsZero() {
+		return s.created
+	}
+	fi, err := os.Stat(segmentFile(s.dir, s.baseOffset, storeExt))
+	if err != nil {
+		// keep what can't be dated
+		return time.Now()
+	}
+	return fi.ModTime()
+}
+
+// expiresAt
+// returns when the last record of the segment to expire does, math.MaxInt64 if one never does.
+// Segments opened with records are read through the first time, which closed segments only are once.
+func (s *segment) expiresAt() (int64, error) {
+	if s.expiryKnown {
+		return s.expiry, nil
+	}
+	var expiry int64
+	err := s.each(func(r *api.Record) error {
+		if exp := expiresAt(r); exp > expiry {
+			expiry = exp
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	s.expiry, s.expiryKnown = expiry, true
+	return expiry, nil
+}
+
+// expiresAt returns when the record expires, math.MaxInt64 if it never does.
+func expiresAt(r *api.Record) int64 {
+	if r.Ttl <= 0 {
+		return math.MaxInt64
+	}
+	return r.AppendTime + r.Ttl
+}
@@ -0,0 +1,119 @@
+package log
+
+import (
+	api "github.com/adityavit/dslog/api/v1"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+	"time"
+)
+
+func newRetentionLog(t *testing.T, c Config) *Log {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "retention_test")
+	assert.NoError(t, err, "error creating dir")
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	c.Segment.MaxIndexBytes = entWidth * 2
+	l, err := newLog(dir, c)
+	assert.NoError(t, err, "error creating log")
+	t.Cleanup(func() { l.Close() })
+	for i := 0; i < 7; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		assert.NoError(t, err, "error appending record")
+	}
+	// segments 0-1, 2-3, 4-5 are closed, 6 is in the active segment
+	return l
+}
+
+func TestRetentionMaxBytes(t *testing.T) {
+	c := Config{}
+	l := newRetentionLog(t, c)
+	assert.Len(t, l.segments, 4, "unexpected number of segments")
+	// keep the last two segments
+	l.Config.Retention.MaxBytes = l.segments[2].size() + l.segments[3].size()
+	assert.NoError(t, l.applyRetention(time.Now()), "error applying retention")
+	lOffset, err := l.LowestOffset()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(4), lOffset, "segments over the size limit are kept")
+	_, err = l.Read(3)
+	assert.Error(t, err, "record of deleted segment is readable")
+	_, err = l.Read(4)
+	assert.NoError(t, err, "record of kept segment is not readable")
+
+	// the active segment is never deleted
+	l.Config.Retention.MaxBytes = 1
+	assert.NoError(t, l.applyRetention(time.Now()), "error applying retention")
+	assert.Equal(t, []*segment{l.activeSegment}, l.segments, "active segment is deleted")
+	m, err := ReadManifest(l.Dir)
+	assert.NoError(t, err, "error reading manifest")
+	assert.Len(t, m.Segments, 1, "manifest still lists deleted segments")
+}
+
+func TestRetentionMaxAge(t *testing.T) {
+	c := Config{}
+	l := newRetentionLog(t, c)
+	assert.Len(t, l.segments, 4, "unexpected number of segments")
+	l.Config.Retention.MaxAge = time.Hour
+	assert.NoError(t, l.applyRetention(time.Now()), "error applying retention")
+	assert.Len(t, l.segments, 4, "segments within the age limit are deleted")
+	assert.NoError(t, l.applyRetention(time.Now().Add(2*time.Hour)), "error applying retention")
+	assert.Equal(t, []*segment{l.activeSegment}, l.segments, "segments over the age limit are kept")
+}
+
+func TestRetentionJanitor(t *testing.T) {
+	c := Config{}
+	c.Retention.MaxBytes = 1
+	c.Retention.CheckInterval = time.Millisecond
+	l := newRetentionLog(t, c)
+	assert.Eventually(t, func() bool {
+		lOffset, err := l.LowestOffset()
+		return err == nil && lOffset == 6
+	}, time.Second, time.Millisecond, "janitor doesn't delete segments")
+	assert.NoError(t, l.MaintenanceErr(), "janitor failed")
+}
+
+func TestRetentionExpiry(t *testing.T) {
+	dir, err := os.MkdirTemp("", "retention_test")
+	assert.NoError(t, err, "error creating dir")
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	l, err := newLog(dir, c)
+	assert.NoError(t, err, "error creating log")
+	defer l.Close()
+	// segments 0-1, 2-3 are closed, 4 is in the active segment
+	for _, ttl := range []time.Duration{time.Minute, time.Hour, time.Minute, 0, time.Minute} {
+		_, err := l.Append(&api.Record{Value: []byte("hello world"), Ttl: int64(ttl)})
+		assert.NoError(t, err, "error appending record")
+	}
+	r, err := l.Read(0)
+	assert.NoError(t, err, "error reading record")
+	assert.Equal(t, uint64(0), r.Offset, "record is expired before its ttl")
+
+	// as after a restart, the expiry of the first segment is read from its records
+	l.mu.Lock()
+	l.segments[0].expiryKnown = false
+	l.mu.Unlock()
+	now := time.Now().Add(2 * time.Minute)
+	assert.NoError(t, l.applyRetention(now), "error applying retention")
+	assert.Len(t, l.segments, 3, "segment with a record left is deleted")
+	assert.NoError(t, l.applyRetention(now.Add(time.Hour)), "error applying retention")
+	assert.Len(t, l.segments, 2, "segment with all records expired is kept")
+	assert.NoError(t, l.applyRetention(now.Add(24*time.Hour)), "error applying retention")
+	assert.Len(t, l.segments, 2, "segment with a record which never expires is deleted")
+}
+
+func TestReadExpired(t *testing.T) {
+	l := newRetentionLog(t, Config{})
+	for _, ttl := range []int64{1, 1, 0} {
+		_, err := l.Append(&api.Record{Value: []byte("hello world"), Ttl: ttl})
+		assert.NoError(t, err, "error appending record")
+	}
+	r, err := l.Read(7)
+	assert.NoError(t, err, "error reading record")
+	assert.Equal(t, uint64(9), r.Offset, "expired records are read")
+	_, err = l.Append(&api.Record{Value: []byte("hello world"), Ttl: 1})
+	assert.NoError(t, err, "error appending record")
+	_, err = l.Read(10)
+	assert.Error(t, err, "expired record at the end of the log is read")
+}
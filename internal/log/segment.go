@@ -4,128 +4,856 @@ import (
 	"fmt"
 	api "github.com/adityavit/dslog/api/v1"
 	"google.golang.org/protobuf/proto"
+	"io"
 	"os"
 	"path"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type segment struct {
-	store                  *store
+	dir                    string
+	store                  *store // the files are nil while a closed segment isn't open, see segmentCache
 	index                  *index
+	timeIndex              *timeIndex
 	baseOffset, nextOffset uint64
+	maxTime                int64 // append time of the last record
+	expiry                 int64 // when the last record to expire does, see expiresAt
+	expiryKnown            bool
+	created                time.Time // creation time from the store header, zero if it isn't known
+	closedSize             uint64    // bytes a closed segment takes up, its files may not be open
 	config                 Config
+	recovery               SegmentRecovery // what was repaired when the segment was opened
+	staged                 []*api.Record   // indexed records waiting to be written in a block, see stage
+	stagedBytes            uint64          // what the staged records take up in the store at most
+
+	// Readers go through the log without its lock, they only see offsets below published
+	// and hold a reference to the segment so it isn't closed under them.
+	published atomic.Uint64
+	refs      atomic.Int32
+	truncMu   sync.RWMutex   // held by readers, and exclusively while records are truncated in place or files opened and closed
+	views     sync.WaitGroup // records handed out pointing into the mapping of the store, see readPublishedRaw
+
+	cache     *segmentCache
+	used      atomic.Uint64 // when the segment was last opened for reading, on the clock of the cache
+	evictable bool          // the files may be closed by the cache, guarded by its lock
+	dropped   bool          // the log let go of the segment, its files aren't opened again, guarded by truncMu
+	readOnly  bool          // the files were opened by openSealed, guarded by truncMu
+	unsealing bool          // unseal is waiting for views, no new ones are handed out, guarded by truncMu
 }
 
 const (
-	storeExt = ".store"
-	indexExt = ".index"
+	storeExt     = ".store"
+	indexExt     = ".index"
+	timeIndexExt = ".timeindex"
 )
 
 func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	s := &segment{
+		dir:        dir,
 		baseOffset: baseOffset,
 		config:     c,
 	}
-	storeFile, err := os.OpenFile(
-		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, storeExt)),
-		os.O_RDWR|os.O_CREATE|os.O_APPEND,
-		0644,
-	)
+	next, maxTime, recovery, err := s.openFiles(true)
 	if err != nil {
 		return nil, err
 	}
-	if s.store, err = newStore(storeFile); err != nil {
-		return nil, err
+	s.nextOffset, s.maxTime, s.recovery = next, maxTime, recovery
+	s.created = s.store.header.Created()
+	// the expiry of a segment with records is only worked out when it is needed
+	s.expiryKnown = s.nextOffset == s.baseOffset
+	s.publish()
+	// the reference of the log
+	s.refs.Store(1)
+	return s, nil
+}
+
+// closedSegment
+// returns the closed segment described by the manifest without opening its files, they are opened when it is read.
+func closedSegment(dir string, ms ManifestSegment, c Config) *segment {
+	s := &segment{
+		dir:        dir,
+		baseOffset: ms.BaseOffset,
+		nextOffset: ms.NextOffset,
+		maxTime:    ms.MaxTime,
+		closedSize: ms.Size,
+		config:     c,
+	}
+	s.publish()
+	s.refs.Store(1)
+	return s
+}
+
+// sealedSize
+// returns what the files of the segment starting at baseOffset in dir take up, 0 if any of them is missing.
+func sealedSize(dir string, baseOffset uint64) uint64 {
+	var size uint64
+	for _, ext := range []string{storeExt, indexExt, timeIndexExt} {
+		fi, err := os.Stat(segmentFile(dir, baseOffset, ext))
+		if err != nil {
+			return 0
+		}
+		size += uint64(fi.Size())
+	}
+	return size
+}
+
+// openFiles
+// opens the files of the segment, repairing them if it wasn't closed cleanly, and returns the offset after
+// the last record, the append time of the last record and what was repaired. The store is only created if create is set.
+func (s *segment) openFiles(create bool) (next uint64, maxTime int64, recovery SegmentRecovery, err error) {
+	flag := os.O_RDWR | os.O_APPEND
+	if create {
+		flag |= os.O_CREATE
+	}
+	// the index and the time index are derived from the store, they are rebuilt if they are missing
+	storeFile, err := os.OpenFile(segmentFile(s.dir, s.baseOffset, storeExt), flag, 0644)
+	if err != nil {
+		return 0, 0, recovery, err
+	}
+	if s.store, err = newStore(storeFile, s.baseOffset, s.config.Segment.Codec); err != nil {
+		return 0, 0, recovery, err
+	}
+	indexFile, err := openSegmentFile(s.dir, s.baseOffset, indexExt)
+	if err != nil {
+		return 0, 0, recovery, err
+	}
+	if s.index, err = newIndex(indexFile, s.baseOffset, s.config); err != nil {
+		return 0, 0, recovery, err
+	}
+	if recovery, err = s.repair(); err != nil {
+		return 0, 0, recovery, err
+	}
+	next = s.baseOffset
+	if off, _, err := s.index.Read(-1); err == nil {
+		next = s.baseOffset + uint64(off) + 1
+	}
+	timeIndexFile, err := openSegmentFile(s.dir, s.baseOffset, timeIndexExt)
+	if err != nil {
+		return 0, 0, recovery, err
+	}
+	if s.timeIndex, err = newTimeIndex(timeIndexFile, s.baseOffset); err != nil {
+		return 0, 0, recovery, err
+	}
+	if maxTime, err = s.loadTimes(next); err != nil {
+		return 0, 0, recovery, err
 	}
-	indexFile, err := os.OpenFile(
-		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, indexExt)),
+	return next, maxTime, recovery, nil
+}
+
+func openSegmentFile(dir string, baseOffset uint64, ext string) (*os.File, error) {
+	return os.OpenFile(
+		segmentFile(dir, baseOffset, ext),
 		os.O_RDWR|os.O_CREATE|os.O_APPEND,
 		0644,
 	)
-	if err != nil {
-		return nil, err
+}
+
+// segmentFile returns the name of the file with ext of the segment starting at baseOffset in dir.
+func segmentFile(dir string, baseOffset uint64, ext string) string {
+	return path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ext))
+}
+
+// loadTimes
+// brings the time index in line with the records of the segment, which the index may be behind or ahead of
+// after a crash, or missing altogether for segments written before it existed, and returns the last append time.
+// next is the offset after the last record.
+func (s *segment) loadTimes(next uint64) (int64, error) {
+	records := next - s.baseOffset
+	if err := s.timeIndex.truncate(uint32(records)); err != nil {
+		return 0, err
 	}
-	if s.index, err = newIndex(indexFile, c); err != nil {
-		return nil, err
+	interval := s.timeIndexInterval()
+	rel := uint64(0)
+	if last, ok := s.timeIndex.last(); ok {
+		rel = uint64(last.offset) + interval
 	}
-	if off, _, err := s.index.Read(-1); err != nil {
-		s.nextOffset = baseOffset
-	} else {
-		s.nextOffset = s.baseOffset + uint64(off) + 1
+	// Only the records which get an entry are read, not every record.
+	for rel < records {
+		r, err := s.Read(s.baseOffset + rel)
+		if err != nil {
+			return 0, err
+		}
+		// the record read is later than asked for if the offset was compacted away
+		rel = r.Offset - s.baseOffset
+		if err = s.timeIndex.Write(r.AppendTime, uint32(rel)); err != nil {
+			return 0, err
+		}
+		rel += interval
 	}
-	return s, nil
+	return s.lastTime(next)
+}
+
+// lastTime returns the append time of the record before next, the offset after the last one of the segment.
+func (s *segment) lastTime(next uint64) (int64, error) {
+	if next == s.baseOffset {
+		return 0, nil
+	}
+	r, err := s.Read(next - 1)
+	if err != nil {
+		return 0, err
+	}
+	return r.AppendTime, nil
+}
+
+func (s *segment) timeIndexInterval() uint64 {
+	if s.config.Segment.TimeIndexInterval == 0 {
+		return 1
+	}
+	return s.config.Segment.TimeIndexInterval
 }
 
 // Append
 // writes the record at the current offset defined by nextOffset - baseOffset
 // returns the offset at which recrd indes is added
 func (s *segment) Append(r *api.Record) (offset uint64, err error) {
-	currOffset := s.nextOffset
-	r.Offset = currOffset
-	recBytes, err := proto.Marshal(r)
-	if err != nil {
-		return 0, err
+	return s.AppendBatch([]*api.Record{r})
+}
+
+// stage
+// indexes the record at its offset, past the last one in the segment, for the block written by writeStaged
+// which starts at the current end of the store.
+func (s *segment) stage(r *api.Record) error {
+	// writes the store position at the offset
+	rel := uint32(r.Offset - s.baseOffset)
+	if err := s.index.Write(rel, s.store.size); err != nil {
+		return err
+	}
+	// every TimeIndexInterval records get an entry in the time index
+	if last, ok := s.timeIndex.last(); !ok || uint64(rel) >= uint64(last.offset)+s.timeIndexInterval() {
+		if err := s.timeIndex.Write(r.AppendTime, rel); err != nil {
+			return err
+		}
+	}
+	if r.AppendTime > s.maxTime {
+		s.maxTime = r.AppendTime
 	}
-	// Append the record to the store
-	// return thw position of the record
-	_, pos, err := s.store.Append(recBytes)
+	if exp := expiresAt(r); exp > s.expiry {
+		s.expiry = exp
+	}
+	if len(s.staged) == 0 {
+		s.stagedBytes = s.store.frame + blockHeaderWidth
+	}
+	s.staged = append(s.staged, r)
+	s.stagedBytes += blockSize(r)
+	s.nextOffset = r.Offset + 1
+	return nil
+}
+
+// stageBatch
+// stages the records at the next offsets, returns the offset of the first one.
+// If any of them can't be staged, the ones already staged are rolled back.
+func (s *segment) stageBatch(records []*api.Record) (offset uint64, err error) {
+	m := s.mark()
+	for _, r := range records {
+		r.Offset = s.nextOffset
+		if err = s.stage(r); err != nil {
+			if rbErr := s.rollback(m); rbErr != nil {
+				return 0, rbErr
+			}
+			return 0, err
+		}
+	}
+	return m.next, nil
+}
+
+// writeStaged appends the staged records to the store as one block.
+func (s *segment) writeStaged() error {
+	if len(s.staged) == 0 {
+		return nil
+	}
+	b, err := encodeBlock(s.staged, s.store.header.codec())
 	if err != nil {
+		return err
+	}
+	if _, _, err = s.store.Append(b); err != nil {
+		return err
+	}
+	s.staged, s.stagedBytes = nil, 0
+	return nil
+}
+
+// appendAt
+// appends the record keeping its offset, which has to be past the last one in the segment.
+// It is used to copy records into a new segment leaving the gaps of the records not copied,
+// they are written in blocks of about maxBlockBytes and the last one once the segment is closed.
+func (s *segment) appendAt(r *api.Record) error {
+	if r.Offset < s.nextOffset {
+		return fmt.Errorf("offset %d is not after the last one in segment %d", r.Offset, s.baseOffset)
+	}
+	if err := s.stage(r); err != nil {
+		return err
+	}
+	if s.stagedBytes >= maxBlockBytes {
+		return s.writeStaged()
+	}
+	return nil
+}
+
+// AppendBatch
+// appends the records with contiguous offsets in one block, returns the offset of the first one.
+// If any of them can't be appended, the ones already written are rolled back.
+func (s *segment) AppendBatch(records []*api.Record) (offset uint64, err error) {
+	m := s.mark()
+	if offset, err = s.stageBatch(records); err != nil {
 		return 0, err
 	}
-	// writes the store position at the offset
-	if err = s.index.Write(uint32(currOffset-s.baseOffset), pos); err != nil {
+	if err = s.writeStaged(); err != nil {
+		if rbErr := s.rollback(m); rbErr != nil {
+			return 0, rbErr
+		}
 		return 0, err
 	}
-	s.nextOffset++
-	return currOffset, nil
+	return offset, nil
+}
+
+// segmentMark is where a segment ended at some point, see rollback.
+type segmentMark struct {
+	storeSize, entries, next uint64
+	maxTime, expiry          int64
+	staged                   int
+	stagedBytes              uint64
+}
+
+// mark returns where the segment ends now.
+func (s *segment) mark() segmentMark {
+	return segmentMark{
+		storeSize:   s.store.size,
+		entries:     s.index.size.Load() / entWidth,
+		next:        s.nextOffset,
+		maxTime:     s.maxTime,
+		expiry:      s.expiry,
+		staged:      len(s.staged),
+		stagedBytes: s.stagedBytes,
+	}
+}
+
+// rollback
+// drops the records appended or staged since m was taken. They must not have been published, but readers may be
+// searching the index past them.
+func (s *segment) rollback(m segmentMark) error {
+	s.truncMu.Lock()
+	defer s.truncMu.Unlock()
+	// whatever else fails, the records dropped are never written
+	s.staged, s.stagedBytes = s.staged[:m.staged], m.stagedBytes
+	if err := s.store.truncate(m.storeSize); err != nil {
+		return err
+	}
+	s.index.truncate(m.entries)
+	if err := s.timeIndex.truncate(uint32(m.next - s.baseOffset)); err != nil {
+		return err
+	}
+	s.nextOffset, s.maxTime, s.expiry = m.next, m.maxTime, m.expiry
+	return nil
+}
+
+// fits
+// checks if the records can be appended without going over the max bytes of the segment.
+// Anything fits into an empty segment, the store is allowed to go over to keep a batch together.
+func (s *segment) fits(records []*api.Record) bool {
+	if s.nextOffset == s.baseOffset {
+		return true
+	}
+	n := uint64(len(records))
+	if s.index.size.Load()+n*entWidth > s.config.Segment.MaxIndexBytes {
+		return false
+	}
+	if max := s.config.Segment.MaxRecords; max > 0 && s.nextOffset-s.baseOffset+n > max {
+		return false
+	}
+	// the records go into a block of their own, or with the ones staged, at most at their size uncompressed
+	size := s.store.size + s.stagedBytes
+	if len(s.staged) == 0 {
+		size += s.store.frame + blockHeaderWidth
+	}
+	for _, r := range records {
+		size += blockSize(r)
+	}
+	return size <= s.config.Segment.MaxStoreBytes
 }
 
 // Read
-// Gets the position of the record from the index stored at the offset
+// Gets the position of the record from the index stored at the offset,
+// if the offset was compacted away the next record in the segment is read instead
 // Use the position to read the record bytes yfrom the store
 // unmarshal the record and return
 func (s *segment) Read(offset uint64) (*api.Record, error) {
-	_, pos, err := s.index.Read(int64(offset - s.baseOffset))
+	b, _, err := s.readRaw(offset)
 	if err != nil {
 		return nil, err
 	}
-	recByte, err := s.store.Read(pos)
+	rec := &api.Record{}
+	if err = proto.Unmarshal(b, rec); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// readRaw
+// reads the record at offset like Read, but returns it marshaled. The bytes point into the mapping of
+// the store if it is mapped and not compressed, aliased reports if they do.
+func (s *segment) readRaw(offset uint64) (b []byte, aliased bool, err error) {
+	entry, err := s.index.Search(uint32(offset - s.baseOffset))
+	if err != nil {
+		return nil, false, err
+	}
+	_, pos, err := s.index.Read(entry)
+	if err != nil {
+		return nil, false, err
+	}
+	if s.store.header.Version == formatVersion {
+		b, aliased, err = s.blockRecord(entry, pos)
+	} else {
+		b, aliased, err = s.store.slice(pos)
+		if codec := s.store.header.codec(); err == nil && codec != CodecNone {
+			aliased = false
+			if b, err = codec.decompress(b); err != nil {
+				err = ErrCorruptRecord{Pos: pos}
+			}
+		}
+	}
+	if corrupt, ok := err.(ErrCorruptRecord); ok {
+		// the store doesn't know which segment it belongs to
+		corrupt.BaseOffset = s.baseOffset
+		return nil, false, corrupt
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return b, aliased, nil
+}
+
+// blockRecord
+// reads the record of the index entry from the block at pos. The last block read is kept decoded,
+// unless it points into the mapping of the store, so reading its records one after the other doesn't
+// decompress it for every one of them.
+func (s *segment) blockRecord(entry int64, pos uint64) (b []byte, aliased bool, err error) {
+	d := s.store.block.Load()
+	if d == nil || d.pos != pos {
+		if b, aliased, err = s.store.slice(pos); err != nil {
+			return nil, false, err
+		}
+		if d, err = decodeBlock(b, pos); err != nil {
+			return nil, false, ErrCorruptRecord{Pos: pos}
+		}
+		if d.data != nil || !aliased {
+			if d.data == nil {
+				d.data = b
+			}
+			s.store.block.Store(d)
+		}
+	}
+	if d.data != nil {
+		b, aliased = d.data, false
+	}
+	// the entries of the records of a block follow each other with its position
+	first := sort.Search(int(entry), func(i int) bool {
+		_, p, err := s.index.Read(int64(i))
+		return err != nil || p >= pos
+	})
+	k := int(entry) - first
+	if k >= len(d.spans) {
+		return nil, false, ErrCorruptRecord{Pos: pos}
+	}
+	return d.record(b, k), aliased, nil
+}
+
+// decode decompresses a record read from a store of an older format, framed on its own, and unmarshals it.
+func (s *segment) decode(b []byte) (*api.Record, error) {
+	b, err := s.store.header.codec().decompress(b)
 	if err != nil {
 		return nil, err
 	}
 	rec := &api.Record{}
-	err = proto.Unmarshal(recByte, rec)
-	if err != nil {
+	if err = proto.Unmarshal(b, rec); err != nil {
 		return nil, err
 	}
 	return rec, nil
 }
 
+// offsetForTime
+// returns the first offset in the segment appended at or after time, false if every record is older.
+func (s *segment) offsetForTime(time int64) (uint64, bool, error) {
+	if s.nextOffset == s.baseOffset || s.maxTime < time {
+		return 0, false, nil
+	}
+	if err := s.open(); err != nil {
+		return 0, false, err
+	}
+	defer s.release()
+	// at most TimeIndexInterval records are scanned from the entry before time
+	for off := s.baseOffset + uint64(s.timeIndex.Lookup(time)); off < s.nextOffset; off++ {
+		r, err := s.Read(off)
+		if err != nil {
+			return 0, false, err
+		}
+		if r.AppendTime >= time {
+			return r.Offset, true, nil
+		}
+		off = r.Offset
+	}
+	return 0, false, nil
+}
+
 // IsMaxed
-// Checks if the store or the index size is greater than the Store or Index max bytes
+// Checks if the store or the index size is greater than the Store or Index max bytes,
+// or the segment holds the max records
 func (s *segment) IsMaxed() bool {
-	return s.store.size >= s.config.Segment.MaxStoreBytes || s.index.size >= s.config.Segment.MaxIndexBytes
+	return s.store.size+s.stagedBytes >= s.config.Segment.MaxStoreBytes || s.index.size.Load() >= s.config.Segment.MaxIndexBytes ||
+		(s.config.Segment.MaxRecords > 0 && s.nextOffset-s.baseOffset >= s.config.Segment.MaxRecords)
 }
 
+// aged reports if the first record of the segment was appended MaxSegmentAge or longer before now.
+func (s *segment) aged(now int64) bool {
+	age := s.config.Segment.MaxSegmentAge
+	// the first record always has an entry in the time index
+	if age <= 0 || len(s.timeIndex.entries) == 0 {
+		return false
+	}
+	return now-s.timeIndex.entries[0].time >= int64(age)
+}
+
+// Flush writes the buffered records of the segment to the operating system.
+func (s *segment) Flush() error {
+	return s.store.Flush()
+}
+
+// Sync commits the records of the segment to disk. The index isn't synced, it is rebuilt from the store after a crash.
+func (s *segment) Sync() error {
+	return s.store.Sync()
+}
+
+// Remove
+// removes the files of the segment and drops the reference of the log to it.
+// Readers still holding the segment keep reading the removed files until they release it.
 func (s *segment) Remove() error {
-	if err := s.Close(); err != nil {
+	s.disown()
+	for _, ext := range []string{storeExt, indexExt, timeIndexExt} {
+		if err := os.Remove(segmentFile(s.dir, s.baseOffset, ext)); err != nil {
+			return err
+		}
+	}
+	return s.release()
+}
+
+// drop
+// drops the reference of the log to the segment once it has been replaced, readers still holding it keep
+// reading its files until the last one releases it.
+func (s *segment) drop() error {
+	s.disown()
+	return s.release()
+}
+
+// disown
+// takes the segment out of the cache before the log lets go of it, so its files are only closed by the last
+// reader, and keeps readers which haven't opened its files yet from opening whatever is at its path now.
+func (s *segment) disown() {
+	s.cache.remove(s)
+	s.truncMu.Lock()
+	s.dropped = true
+	s.truncMu.Unlock()
+}
+
+// pinSegments
+// opens the files of the segments and keeps them open until unpin is called, so readers still holding them
+// keep reading them once they are replaced or removed.
+func pinSegments(segments []*segment) (unpin func(), err error) {
+	unpin = func() {
+		for _, seg := range segments {
+			// a segment the log let go of is closed by its last reader, there is nobody to tell if that fails
+			seg.release()
+		}
+	}
+	for i, seg := range segments {
+		if err := seg.open(); err != nil {
+			segments = segments[:i]
+			unpin()
+			return nil, err
+		}
+	}
+	return unpin, nil
+}
+
+// publish makes the records appended so far visible to readers.
+func (s *segment) publish() {
+	s.published.Store(s.nextOffset)
+}
+
+// acquire takes a reference to the segment for a reader, false is returned if it has been closed.
+func (s *segment) acquire() bool {
+	for {
+		n := s.refs.Load()
+		if n <= 0 {
+			return false
+		}
+		if s.refs.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+// release drops a reference to the segment, the last one closes it.
+func (s *segment) release() error {
+	if s.refs.Add(-1) == 0 {
+		return s.Close()
+	}
+	return nil
+}
+
+// readPublished
+// reads the first record at or after offset which has been published, io.EOF is returned if there is none.
+// It is called by readers holding a reference to the segment.
+func (s *segment) readPublished(offset uint64) (*api.Record, error) {
+	s.truncMu.RLock()
+	defer s.truncMu.RUnlock()
+	published := s.published.Load()
+	if offset >= published {
+		return nil, io.EOF
+	}
+	r, err := s.Read(offset)
+	if err != nil {
+		return nil, err
+	}
+	if r.Offset >= published {
+		return nil, io.EOF
+	}
+	return r, nil
+}
+
+// readPublishedRaw
+// reads the first record at or after offset which has been published like readPublished, but returns it marshaled
+// along with its offset and when it expires. If the bytes point into the mapping of the store they are counted
+// in views, and the caller has to call views.Done once it is done with them.
+func (s *segment) readPublishedRaw(offset uint64) (b []byte, aliased bool, off uint64, expiry int64, err error) {
+	s.truncMu.RLock()
+	defer s.truncMu.RUnlock()
+	published := s.published.Load()
+	if offset >= published {
+		return nil, false, 0, 0, io.EOF
+	}
+	if b, aliased, err = s.readRaw(offset); err != nil {
+		return nil, false, 0, 0, err
+	}
+	if off, expiry, err = recordMeta(b); err != nil {
+		return nil, false, 0, 0, err
+	}
+	if off >= published {
+		return nil, false, 0, 0, io.EOF
+	}
+	if aliased && s.unsealing {
+		// unseal is waiting for the views handed out so far, holders reading again get copies
+		b, aliased = append([]byte(nil), b...), false
+	}
+	if aliased {
+		s.views.Add(1)
+	}
+	return b, aliased, off, expiry, nil
+}
+
+// seal
+// maps the store of the segment read-only and shrinks its index to the entries written and maps it read-only,
+// once the segment is closed for appends. The store is synced, so the manifest can be trusted with what the
+// segment holds and its files can be closed by the cache from then on.
+func (s *segment) seal() error {
+	s.truncMu.Lock()
+	err := s.store.Sync()
+	if err == nil {
+		err = s.sealFiles()
+	}
+	if err == nil {
+		s.closedSize = s.fileSize()
+	}
+	s.truncMu.Unlock()
+	if err != nil {
 		return err
 	}
-	if err := os.Remove(s.store.Name()); err != nil {
+	s.cache.add(s)
+	return nil
+}
+
+// sealFiles maps the store and the index of a closed segment read-only, it is called under truncMu.
+func (s *segment) sealFiles() error {
+	if err := s.store.mapReadOnly(); err != nil {
 		return err
 	}
-	if err := os.Remove(s.index.Name()); err != nil {
+	return s.index.seal()
+}
+
+// unseal
+// undoes seal for a closed segment to become the active one again, once the records handed out pointing
+// into the mapping of its store have been released. Its files are opened if they were closed.
+func (s *segment) unseal() error {
+	s.cache.remove(s)
+	// readers aren't kept out while the views are waited for, their holders may read again before releasing them
+	s.truncMu.Lock()
+	s.unsealing = true
+	s.truncMu.Unlock()
+	s.views.Wait()
+	s.truncMu.Lock()
+	defer s.truncMu.Unlock()
+	s.unsealing = false
+	s.closedSize = 0
+	if s.readOnly {
+		if err := s.closeFiles(); err != nil {
+			return err
+		}
+		s.store, s.index, s.timeIndex = nil, nil, nil
+		s.readOnly = false
+	}
+	if s.store == nil {
+		// opened afresh the files are writable
+		_, _, _, err := s.openFiles(false)
 		return err
 	}
+	if err := s.store.unmap(); err != nil {
+		return err
+	}
+	return s.index.unseal(s.config.Segment.MaxIndexBytes)
+}
+
+// open
+// takes a reference to the segment and opens its files if the cache closed them, they aren't closed again until
+// the reference is released. errSegmentClosed is returned if the segment has been closed for good.
+func (s *segment) open() error {
+	if !s.acquire() {
+		return errSegmentClosed
+	}
+	s.truncMu.RLock()
+	opened := s.store != nil
+	s.truncMu.RUnlock()
+	if !opened {
+		if err := s.reopen(); err != nil {
+			s.release()
+			return err
+		}
+	}
+	s.cache.touch(s, !opened)
 	return nil
 }
 
-func (s *segment) Close() error {
-	if err := s.store.Close(); err != nil {
+// reopen opens the files of a closed segment the cache closed, read-only, see openSealed.
+func (s *segment) reopen() error {
+	s.truncMu.Lock()
+	defer s.truncMu.Unlock()
+	if s.store != nil {
+		return nil
+	}
+	if s.dropped {
+		return errSegmentClosed
+	}
+	if err := s.openSealed(); err != nil {
+		s.closeFiles()
+		s.store, s.index, s.timeIndex = nil, nil, nil
+		return err
+	}
+	s.readOnly = true
+	return nil
+}
+
+// openSealed
+// opens the files of a closed segment as they were when it was sealed, read-only. Nothing is created or
+// repaired, files which don't hold what was recorded for the segment when it was sealed are ErrCorrupt.
+// Segments whose files don't add up to it are opened and repaired when the log is set up instead.
+func (s *segment) openSealed() error {
+	storeFile, err := os.Open(segmentFile(s.dir, s.baseOffset, storeExt))
+	if err != nil {
+		return err
+	}
+	if s.store, err = newStore(storeFile, s.baseOffset, s.config.Segment.Codec); err != nil {
+		storeFile.Close()
 		return err
 	}
-	if err := s.index.Close(); err != nil {
+	indexFile, err := os.Open(segmentFile(s.dir, s.baseOffset, indexExt))
+	if err != nil {
 		return err
 	}
+	if s.index, err = openSealedIndex(indexFile, s.baseOffset); err != nil {
+		indexFile.Close()
+		return err
+	}
+	timeIndexFile, err := os.Open(segmentFile(s.dir, s.baseOffset, timeIndexExt))
+	if err != nil {
+		return err
+	}
+	if s.timeIndex, err = newTimeIndex(timeIndexFile, s.baseOffset); err != nil {
+		timeIndexFile.Close()
+		return err
+	}
+	// records compacted away at the end of the segment leave it short of its next offset
+	next := s.baseOffset
+	if off, _, err := s.index.Read(-1); err == nil {
+		next = s.baseOffset + uint64(off) + 1
+	}
+	if next > s.nextOffset {
+		return fmt.Errorf("segment %d doesn't match what was recorded when it was sealed: %w", s.baseOffset, ErrCorrupt)
+	}
+	maxTime, err := s.lastTime(next)
+	if err != nil {
+		return err
+	}
+	if s.fileSize() != s.closedSize || maxTime != s.maxTime {
+		return fmt.Errorf("segment %d doesn't match what was recorded when it was sealed: %w", s.baseOffset, ErrCorrupt)
+	}
+	return s.store.mapReadOnly()
+}
+
+// closeIdle
+// closes the files of the segment unless somebody besides the log holds a reference to it, and reports if it did.
+func (s *segment) closeIdle() bool {
+	if !s.truncMu.TryLock() {
+		return false
+	}
+	defer s.truncMu.Unlock()
+	if s.refs.Load() != 1 {
+		return false
+	}
+	// nothing was written to a closed segment, the next read opens it again if closing failed half way
+	s.closeFiles()
+	s.store, s.index, s.timeIndex = nil, nil, nil
+	return true
+}
+
+// removeSegmentFiles removes whatever files of the segment starting at baseOffset are left in dir.
+func removeSegmentFiles(dir string, baseOffset uint64) error {
+	for _, ext := range []string{storeExt, indexExt, timeIndexExt} {
+		err := os.Remove(segmentFile(dir, baseOffset, ext))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *segment) Close() error {
+	// the last block of records copied into the segment, see appendAt
+	if err := s.writeStaged(); err != nil {
+		return err
+	}
+	s.cache.remove(s)
+	s.truncMu.Lock()
+	defer s.truncMu.Unlock()
+	return s.closeFiles()
+}
+
+// closeFiles closes the files of the segment which are open, it is called under truncMu.
+func (s *segment) closeFiles() error {
+	if s.store != nil {
+		if err := s.store.Close(); err != nil {
+			return err
+		}
+	}
+	if s.index != nil {
+		if err := s.index.Close(); err != nil {
+			return err
+		}
+	}
+	if s.timeIndex != nil {
+		if err := s.timeIndex.Close(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -1,6 +1,7 @@
 package log
 
 import (
+	"errors"
 	api "github.com/adityavit/dslog/api/v1"
 	"github.com/stretchr/testify/assert"
 	"io"
@@ -38,6 +39,7 @@ func TestSegment(t *testing.T) {
 	c.Segment.MaxStoreBytes = uint64(len(rec.Value) * 3)
 	c.Segment.MaxIndexBytes = 1024
 
+	assert.NoError(t, s.Close(), "error closing segment")
 	s, err = newSegment(dir, 16, c)
 	assert.NoError(t, err, "received error when creating segment again with different configuration")
 	assert.True(t, s.IsMaxed(), "There should not be space in the segment")
@@ -47,3 +49,54 @@ func TestSegment(t *testing.T) {
 	assert.NoError(t, err, "Error when creating segment again after deletion")
 	assert.False(t, s.IsMaxed(), "segment should be empty after creating again")
 }
+
+func TestSegmentCorruptRecord(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "segment_corrupt_test")
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	c.Segment.MaxStoreBytes = 1024
+	s, err := newSegment(dir, 16, c)
+	assert.NoError(t, err, "error creating segment")
+	off, err := s.Append(&api.Record{Value: []byte("hello world")})
+	assert.NoError(t, err, "error appending the record to the segment")
+	assert.NoError(t, s.store.Flush(), "error flushing the store")
+
+	// overwrite the last byte of the record
+	f, err := os.OpenFile(s.store.Name(), os.O_WRONLY, 0644)
+	assert.NoError(t, err, "error opening store file")
+	_, err = f.WriteAt([]byte{0xff}, int64(s.store.size-1))
+	assert.NoError(t, err, "error corrupting store file")
+	assert.NoError(t, f.Close())
+
+	_, err = s.Read(off)
+	assert.Equal(t, ErrCorruptRecord{BaseOffset: 16, Pos: headerWidth}, err, "corrupt record is not reported")
+	assert.True(t, errors.Is(err, ErrCorrupt), "corrupt record doesn't match ErrCorrupt")
+}
+
+func TestSegmentAppendBatchRollback(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "segment_batch_test")
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	c.Segment.MaxStoreBytes = 1024
+	s, err := newSegment(dir, 16, c)
+	assert.NoError(t, err, "error creating segment")
+	rec := &api.Record{Value: []byte("hello world")}
+	off, err := s.AppendBatch([]*api.Record{rec, rec})
+	assert.NoError(t, err, "error appending batch")
+	assert.Equal(t, uint64(16), off, "batch doesn't start at the next offset")
+
+	// the second record of the batch doesn't fit in the index
+	size := s.store.size
+	_, err = s.AppendBatch([]*api.Record{rec, rec})
+	assert.Equal(t, io.EOF, err, "full index is not reported")
+	assert.Equal(t, uint64(18), s.nextOffset, "failed batch is not rolled back")
+	assert.Equal(t, size, s.store.size, "failed batch is left in the store")
+	_, err = s.Read(18)
+	assert.Error(t, err, "part of a failed batch is readable")
+	off, err = s.Append(rec)
+	assert.NoError(t, err, "error appending after rollback")
+	assert.Equal(t, uint64(18), off, "offset of failed batch is not reused")
+	assert.NoError(t, s.Close())
+}
@@ -1,38 +1,68 @@
 package log
 
 import (
-	"bufio"
 	"encoding/binary"
+	"fmt"
+	"github.com/tysonmote/gommap"
+	"hash/crc32"
+	"io"
+	"math"
 	"os"
 	"sync"
+	"sync/atomic"
 )
 
 var (
-	enc = binary.BigEndian
+	enc      = binary.BigEndian
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
 )
 
 const (
-	lenWidth = 8 // Size of 8 bytes 64 bits to store the length of the record data, before the actual byte data of record
+	lenWidth   = 8                   // Size of 8 bytes 64 bits to store the length of the record data, before the actual byte data of record
+	crcWidth   = 4                   // Size of 4 bytes to store the CRC32C checksum of the record data, after the length
+	frameWidth = lenWidth + crcWidth // Size of the framing written before every record
 )
 
+// bufferSize is how many bytes of records the store buffers before writing them to the file.
+const bufferSize = 4096
+
 type store struct {
 	*os.File
-	mu   sync.Mutex
-	buf  *bufio.Writer
-	size uint64
+	mu      sync.Mutex
+	buf     []byte        // records appended but not written to the file yet
+	size    uint64        // bytes in the store, buffered ones included
+	flushed atomic.Uint64 // bytes written to the file, reads below it don't take the lock
+	header  header
+	frame   uint64                       // width of the framing before each record, legacy stores have no checksum
+	mmap    atomic.Pointer[gommap.MMap]  // read-only mapping of a store closed for appends, see mapReadOnly
+	block   atomic.Pointer[decodedBlock] // the block last read, see segment.blockRecord
 }
 
-func newStore(f *os.File) (*store, error) {
-	fi, err := os.Stat(f.Name())
+// newStore opens the store of the segment starting at baseOffset, a new store compresses its records with codec.
+func newStore(f *os.File, baseOffset uint64, codec Codec) (*store, error) {
+	// the codec would be masked in the flags of the header
+	if codec > CodecZlib {
+		return nil, fmt.Errorf("%s: unsupported codec %d", f.Name(), codec)
+	}
+	h, size, err := setupHeader(f, storeMagic, baseOffset, uint16(codec))
 	if err != nil {
 		return nil, err
 	}
-	size := fi.Size()
-	return &store{
-		File: f,
-		size: uint64(size),
-		buf:  bufio.NewWriter(f),
-	}, nil
+	if c := h.codec(); c > CodecZlib {
+		return nil, fmt.Errorf("%s: unsupported codec %d", f.Name(), c)
+	}
+	s := &store{
+		File:   f,
+		size:   size,
+		buf:    make([]byte, 0, bufferSize),
+		header: h,
+		frame:  frameWidth,
+	}
+	s.flushed.Store(size)
+	if h.Version == legacyVersion {
+		s.frame = lenWidth
+	}
+	return s, nil
 }
 
 func (s *store) Append(b []byte) (n uint64, pos uint64, err error) {
@@ -40,53 +70,245 @@ func (s *store) Append(b []byte) (n uint64, pos uint64, err error) {
 	defer s.mu.Unlock()
 	// pos the start of the record
 	pos = s.size
-	// Store the length of the record bytes in the butter first in enc byte order.
-	if err = binary.Write(s.buf, enc, uint64(len(b))); err != nil {
-		return 0, 0, err
+	// Store the length of the record bytes in the buffer first in enc byte order.
+	s.buf = enc.AppendUint64(s.buf, uint64(len(b)))
+	// Store the checksum of the record bytes so that a torn or flipped record is detected on read.
+	if s.frame == frameWidth {
+		s.buf = enc.AppendUint32(s.buf, crc32.Checksum(b, crcTable))
 	}
 	// write the record bytes in buffer
-	w, err := s.buf.Write(b)
-	if err != nil {
-		return 0, 0, err
+	s.buf = append(s.buf, b...)
+	w := s.frame + uint64(len(b))
+	s.size += w
+	if len(s.buf) >= bufferSize {
+		if err = s.flush(); err != nil {
+			return 0, 0, err
+		}
 	}
-	w += lenWidth
-	s.size += uint64(w)
-	return uint64(w), pos, nil
+	return w, pos, nil
 }
 
+// Read
+// reads the record at pos. Records already written to the file are read without taking the lock,
+// the ones still buffered are copied from the buffer, reads never flush it.
 func (s *store) Read(pos uint64) ([]byte, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	if err := s.buf.Flush(); err != nil {
-		return nil, err
-	}
-	// Get size of the log record at the pos of length
-	sizeByte := make([]byte, lenWidth)
-	if _, err := s.File.ReadAt(sizeByte, int64(pos)); err != nil {
+	// Get size and checksum of the log record at the pos of length
+	hdr := make([]byte, s.frame)
+	if err := s.readAt(hdr, pos); err != nil {
 		return nil, err
 	}
 	// Convert size into big endian
-	size := enc.Uint64(sizeByte)
+	size := enc.Uint64(hdr[:lenWidth])
+	// A length running past the end of the store means the record was torn or the length is garbage.
+	if !s.holds(pos+s.frame, size) {
+		return nil, ErrCorruptRecord{Pos: pos}
+	}
 	data := make([]byte, size)
-	if _, err := s.File.ReadAt(data, int64(pos+lenWidth)); err != nil {
+	if err := s.readAt(data, pos+s.frame); err != nil {
 		return nil, err
 	}
+	if s.frame == frameWidth && crc32.Checksum(data, crcTable) != enc.Uint32(hdr[lenWidth:]) {
+		return nil, ErrCorruptRecord{Pos: pos}
+	}
 	return data, nil
 }
 
 func (s *store) ReadAt(p []byte, off int64) (n int, err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if err = s.buf.Flush(); err != nil {
-		return 0, err
+	if uint64(off) >= s.size {
+		return 0, io.EOF
+	}
+	n = len(p)
+	if left := s.size - uint64(off); uint64(n) > left {
+		n, err = int(left), io.EOF
+	}
+	if rerr := s.readLocked(p[:n], uint64(off)); rerr != nil {
+		return 0, rerr
+	}
+	return n, err
+}
+
+// slice
+// reads the record at pos like Read, but when the store is mapped the bytes returned point into the mapping
+// instead of being copied, aliased reports if they do. They are only valid until the store is unmapped.
+func (s *store) slice(pos uint64) (b []byte, aliased bool, err error) {
+	m := s.mmap.Load()
+	if m == nil || pos+s.frame > uint64(len(*m)) {
+		b, err = s.Read(pos)
+		return b, false, err
+	}
+	mm := *m
+	size := enc.Uint64(mm[pos : pos+lenWidth])
+	// the mapping covers every record of the store, a length running past it is garbage
+	if size > uint64(len(mm))-pos-s.frame {
+		return nil, false, ErrCorruptRecord{Pos: pos}
+	}
+	start := pos + s.frame
+	b = mm[start : start+size : start+size]
+	if s.frame == frameWidth && crc32.Checksum(b, crcTable) != enc.Uint32(mm[pos+lenWidth:start]) {
+		return nil, false, ErrCorruptRecord{Pos: pos}
 	}
-	return s.File.ReadAt(p, off)
+	return b, true, nil
+}
+
+// mapReadOnly
+// maps the store read-only once it is closed for appends, from then on its records are read from the mapping.
+// The buffered records are written first so the mapping covers every record.
+func (s *store) mapReadOnly() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.mmap.Load() != nil || s.size == 0 {
+		return nil
+	}
+	if err := s.flush(); err != nil {
+		return err
+	}
+	m, err := gommap.Map(s.File.Fd(), gommap.PROT_READ, gommap.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	s.mmap.Store(&m)
+	return nil
+}
+
+// unmap drops the mapping of the store, nothing read from it may be used afterwards.
+func (s *store) unmap() error {
+	if m := s.mmap.Swap(nil); m != nil {
+		return m.UnsafeUnmap()
+	}
+	return nil
+}
+
+// holds reports if the n bytes from off are in the store.
+func (s *store) holds(off, n uint64) bool {
+	if n > math.MaxUint64-off {
+		return false
+	}
+	if off+n <= s.flushed.Load() {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return off+n <= s.size
+}
+
+// readAt fills p with the bytes at off, io.EOF is returned if they aren't all in the store.
+func (s *store) readAt(p []byte, off uint64) error {
+	if off+uint64(len(p)) <= s.flushed.Load() {
+		_, err := s.File.ReadAt(p, int64(off))
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.readLocked(p, off)
+}
+
+// readLocked fills p with the bytes at off from the file and the buffer, it is called under the lock.
+func (s *store) readLocked(p []byte, off uint64) error {
+	flushed := s.flushed.Load()
+	if off+uint64(len(p)) > flushed+uint64(len(s.buf)) {
+		return io.EOF
+	}
+	n := 0
+	if off < flushed {
+		onFile := p
+		if uint64(len(p)) > flushed-off {
+			onFile = p[:flushed-off]
+		}
+		var err error
+		if n, err = s.File.ReadAt(onFile, int64(off)); err != nil {
+			return err
+		}
+	}
+	copy(p[n:], s.buf[off+uint64(n)-flushed:])
+	return nil
+}
+
+// flush writes the buffer to the file, it is called under the lock.
+func (s *store) flush() error {
+	// a store opened read-only takes no writes at all
+	if len(s.buf) == 0 {
+		return nil
+	}
+	n, err := s.File.Write(s.buf)
+	s.flushed.Add(uint64(n))
+	s.buf = s.buf[:copy(s.buf, s.buf[n:])]
+	return err
+}
+
+// Flush writes the buffered records to the operating system.
+func (s *store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flush()
+}
+
+// Sync writes the buffered records to the operating system and commits them to disk.
+func (s *store) Sync() error {
+	if err := s.Flush(); err != nil {
+		return err
+	}
+	return s.File.Sync()
+}
+
+// truncate
+// discards everything in the store from size onwards. Records which are still buffered are dropped without
+// touching the file, so records which failed to be written can be discarded.
+func (s *store) truncate(size uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// a block is written at the position of one truncated
+	s.block.Store(nil)
+	if flushed := s.flushed.Load(); size >= flushed {
+		s.buf = s.buf[:size-flushed]
+		s.size = size
+		return nil
+	}
+	// the file can't shrink under the mapping
+	if err := s.unmap(); err != nil {
+		return err
+	}
+	if err := s.File.Truncate(int64(size)); err != nil {
+		return err
+	}
+	s.buf = s.buf[:0]
+	s.size = size
+	s.flushed.Store(size)
+	return nil
+}
+
+// upgrade
+// rewrites the header of an empty store written in an older format with the current one, so records are
+// appended to it in blocks compressed with codec.
+func (s *store) upgrade(codec Codec) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.File.Truncate(0); err != nil {
+		return err
+	}
+	h, size, err := setupHeader(s.File, storeMagic, s.header.BaseOffset, uint16(codec))
+	if err != nil {
+		return err
+	}
+	s.header, s.frame = h, frameWidth
+	s.buf = s.buf[:0]
+	s.size = size
+	s.flushed.Store(size)
+	s.block.Store(nil)
+	return nil
 }
 
 func (s *store) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if err := s.buf.Flush(); err != nil {
+	if err := s.unmap(); err != nil {
+		return err
+	}
+	if err := s.flush(); err != nil {
+		return err
+	}
+	if err := s.File.Sync(); err != nil {
 		return err
 	}
 	return s.File.Close()
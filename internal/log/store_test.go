@@ -8,14 +8,14 @@ import (
 
 var (
 	write = []byte("hello world")
-	width = uint64(len(write)) + lenWidth
+	width = uint64(len(write)) + frameWidth
 )
 
 func TestStoreAppendRead(t *testing.T) {
 	f, err := os.CreateTemp("", "store_append_read_test")
 	assert.Nil(t, err)
 	defer os.Remove(f.Name())
-	s, err := newStore(f)
+	s, err := newStore(f, 0, CodecNone)
 	assert.Nil(t, err)
 	assert.NotNil(t, s, "Store should not be nil")
 	testAppend(t, s)
@@ -27,13 +27,13 @@ func testAppend(t *testing.T, s *store) {
 	t.Helper()
 	n, pos, err := s.Append(write)
 	assert.Nil(t, err)
-	assert.Equal(t, pos, uint64(0), "doesn't start with first position")
+	assert.Equal(t, pos, uint64(headerWidth), "doesn't start with first position after the header")
 	assert.Equal(t, n, width, "doesn't match the width")
 }
 
 func testRead(t *testing.T, s *store) {
 	t.Helper()
-	data, err := s.Read(0)
+	data, err := s.Read(headerWidth)
 	assert.Nil(t, err)
 	assert.Equal(t, data, write)
 }
@@ -42,23 +42,48 @@ func testReadAt(t *testing.T, s *store) {
 	t.Helper()
 	// read the width first
 	lenByte := make([]byte, lenWidth)
-	n, err := s.ReadAt(lenByte, 0)
+	n, err := s.ReadAt(lenByte, headerWidth)
 	assert.Nil(t, err)
 	assert.Equal(t, n, lenWidth)
 	assert.Equal(t, enc.Uint64(lenByte), uint64(len(write)))
 	dataByte := make([]byte, len(write))
-	n, err = s.ReadAt(dataByte, lenWidth)
+	n, err = s.ReadAt(dataByte, headerWidth+frameWidth)
 	assert.Nil(t, err)
 	assert.Equal(t, n, len(write))
 	assert.Equal(t, dataByte, write)
 }
 
+func TestStoreCorruptRecord(t *testing.T) {
+	f, err := os.CreateTemp("", "store_corrupt_record_test")
+	assert.Nil(t, err, "Error creating temp file")
+	defer os.Remove(f.Name())
+	s, err := newStore(f, 0, CodecNone)
+	assert.Nil(t, err, "Error creating store")
+	_, pos, err := s.Append(write)
+	assert.Nil(t, err, "Error appending to store")
+	assert.Nil(t, s.Flush(), "Error flushing store")
+
+	// flip a bit in the record data
+	_, err = s.File.WriteAt([]byte{write[0] ^ 0x01}, int64(pos+frameWidth))
+	assert.Nil(t, err, "Error corrupting store")
+	_, err = s.Read(pos)
+	assert.Equal(t, ErrCorruptRecord{Pos: pos}, err, "checksum mismatch is not reported")
+
+	// length running past the end of the store
+	lenByte := make([]byte, lenWidth)
+	enc.PutUint64(lenByte, 1<<20)
+	_, err = s.File.WriteAt(lenByte, int64(pos))
+	assert.Nil(t, err, "Error corrupting store")
+	_, err = s.Read(pos)
+	assert.Equal(t, ErrCorruptRecord{Pos: pos}, err, "torn record is not reported")
+}
+
 func TestStoreClose(t *testing.T) {
 	f, err := os.CreateTemp("", "store_close_store")
 	assert.Nil(t, err, "Error creating temp file")
 	defer os.Remove(f.Name())
 	fName := f.Name()
-	s, err := newStore(f)
+	s, err := newStore(f, 0, CodecNone)
 	assert.Nil(t, err, "Error creating store")
 	_, _, err = s.Append(write)
 	assert.Nil(t, err, "Error appending to store")
@@ -85,3 +110,68 @@ func openFile(name string) (file *os.File, size int64, err error) {
 	return f, fi.Size(), nil
 
 }
+
+func TestStoreReadBuffered(t *testing.T) {
+	f, err := os.CreateTemp("", "store_read_buffered_test")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	s, err := newStore(f, 0, CodecNone)
+	assert.Nil(t, err)
+
+	_, pos, err := s.Append(write)
+	assert.Nil(t, err)
+	read, err := s.Read(pos)
+	assert.Nil(t, err)
+	assert.Equal(t, write, read, "buffered record doesn't match")
+	fi, err := f.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(headerWidth), fi.Size(), "read flushes the buffer")
+
+	// records are read while others are appended and flushed
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			read, err := s.Read(pos)
+			assert.Nil(t, err)
+			assert.Equal(t, write, read, "record doesn't match while appending")
+		}
+	}()
+	var last uint64
+	for i := 0; i < 1000; i++ {
+		_, last, err = s.Append(write)
+		assert.Nil(t, err)
+	}
+	<-done
+	read, err = s.Read(last)
+	assert.Nil(t, err)
+	assert.Equal(t, write, read, "last record doesn't match")
+	assert.Less(t, s.flushed.Load(), s.size, "last records aren't buffered")
+	assert.Greater(t, s.flushed.Load(), uint64(headerWidth), "full buffer isn't flushed")
+}
+
+func TestStoreMapReadOnly(t *testing.T) {
+	f, err := os.CreateTemp("", "store_map_test")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	s, err := newStore(f, 0, CodecNone)
+	assert.Nil(t, err)
+	_, pos, err := s.Append(write)
+	assert.Nil(t, err)
+	read, aliased, err := s.slice(pos)
+	assert.Nil(t, err)
+	assert.False(t, aliased, "unmapped store is aliased")
+	assert.Equal(t, write, read)
+
+	assert.Nil(t, s.mapReadOnly())
+	read, aliased, err = s.slice(pos)
+	assert.Nil(t, err)
+	assert.True(t, aliased, "record isn't read from the mapping")
+	assert.Equal(t, write, read, "mapped record doesn't match")
+	assert.Equal(t, 0.0, testing.AllocsPerRun(10, func() { s.slice(pos) }), "mapped read allocates")
+
+	// the store is unmapped before it is truncated
+	assert.Nil(t, s.truncate(pos))
+	assert.Nil(t, s.mmap.Load(), "truncated store is still mapped")
+	assert.Nil(t, s.Close())
+}
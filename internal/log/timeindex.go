@@ -0,0 +1,116 @@
+package log
+
+import (
+	"io"
+	"os"
+	"sort"
+)
+
+var (
+	timeWidth      uint64 = 8                    // 8 bytes
+	timeEntryWidth        = timeWidth + offWidth // 12 bytes
+)
+
+var timeIndexMagic = [4]byte{'D', 'S', 'L', 'T'}
+
+// timeIndex
+// maps append times to offsets of a segment. It is sparse, an entry is written every TimeIndexInterval
+// records, so it is small enough to be kept in memory and only appended to on disk.
+type timeIndex struct {
+	file    *os.File
+	header  header
+	entries []timeEntry
+}
+
+type timeEntry struct {
+	time   int64  // append time of the record
+	offset uint32 // relative to the segment base
+}
+
+func newTimeIndex(f *os.File, baseOffset uint64) (*timeIndex, error) {
+	h, size, err := setupHeader(f, timeIndexMagic, baseOffset, 0)
+	if err != nil {
+		return nil, err
+	}
+	t := &timeIndex{
+		file:   f,
+		header: h,
+	}
+	b := make([]byte, size-h.start())
+	if _, err = f.ReadAt(b, int64(h.start())); err != nil && err != io.EOF {
+		return nil, err
+	}
+	for pos := uint64(0); pos+timeEntryWidth <= uint64(len(b)); pos += timeEntryWidth {
+		t.entries = append(t.entries, timeEntry{
+			time:   int64(enc.Uint64(b[pos : pos+timeWidth])),
+			offset: enc.Uint32(b[pos+timeWidth : pos+timeEntryWidth]),
+		})
+	}
+	// a partial entry was torn by a crash
+	if uint64(len(b))%timeEntryWidth != 0 {
+		if err = t.truncateFile(); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// Write appends an entry for the record at the relative offset, appended at time.
+func (t *timeIndex) Write(time int64, offset uint32) error {
+	b := make([]byte, timeEntryWidth)
+	enc.PutUint64(b[:timeWidth], uint64(time))
+	enc.PutUint32(b[timeWidth:], offset)
+	if _, err := t.file.Write(b); err != nil {
+		return err
+	}
+	t.entries = append(t.entries, timeEntry{time: time, offset: offset})
+	return nil
+}
+
+// Lookup
+// returns the relative offset to start scanning from for the first record appended at or after time,
+// that is the offset of the last entry before time.
+func (t *timeIndex) Lookup(time int64) uint32 {
+	i := sort.Search(len(t.entries), func(i int) bool {
+		return t.entries[i].time >= time
+	})
+	if i == 0 {
+		return 0
+	}
+	return t.entries[i-1].offset
+}
+
+// last returns the last entry, false if there is none.
+func (t *timeIndex) last() (timeEntry, bool) {
+	if len(t.entries) == 0 {
+		return timeEntry{}, false
+	}
+	return t.entries[len(t.entries)-1], true
+}
+
+// truncate drops the entries for relative offsets from offset onwards.
+func (t *timeIndex) truncate(offset uint32) error {
+	i := sort.Search(len(t.entries), func(i int) bool {
+		return t.entries[i].offset >= offset
+	})
+	if i == len(t.entries) {
+		return nil
+	}
+	t.entries = t.entries[:i]
+	return t.truncateFile()
+}
+
+func (t *timeIndex) truncateFile() error {
+	return t.file.Truncate(int64(t.header.start() + uint64(len(t.entries))*timeEntryWidth))
+}
+
+func (t *timeIndex) Name() string {
+	return t.file.Name()
+}
+
+func (t *timeIndex) Close() error {
+	if err := t.file.Sync(); err != nil {
+		return err
+	}
+	return t.file.Close()
+}
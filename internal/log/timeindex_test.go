@@ -0,0 +1,101 @@
+package log
+
+import (
+	api "github.com/adityavit/dslog/api/v1"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTimeIndex(t *testing.T) {
+	f, err := os.CreateTemp("", "time_index_test")
+	assert.NoError(t, err, "error creating temp file")
+	defer os.Remove(f.Name())
+	assert.NoError(t, f.Close())
+	// the time index is only ever appended to, like the segment opens it
+	f, err = os.OpenFile(f.Name(), os.O_RDWR|os.O_APPEND, 0644)
+	assert.NoError(t, err, "error opening time index")
+	ti, err := newTimeIndex(f, 0)
+	assert.NoError(t, err, "error creating time index")
+	assert.Equal(t, uint32(0), ti.Lookup(100), "empty time index should start at the segment base")
+
+	for i, ts := range []int64{10, 20, 30} {
+		assert.NoError(t, ti.Write(ts, uint32(i*4)), "error writing time index entry")
+	}
+	assert.Equal(t, uint32(0), ti.Lookup(5), "lookup before the first entry")
+	assert.Equal(t, uint32(0), ti.Lookup(20), "lookup of an entry's time doesn't start before it")
+	assert.Equal(t, uint32(4), ti.Lookup(25), "lookup between entries")
+	assert.Equal(t, uint32(8), ti.Lookup(40), "lookup after the last entry")
+
+	assert.NoError(t, ti.truncate(5), "error truncating time index")
+	last, ok := ti.last()
+	assert.True(t, ok, "truncated time index is empty")
+	assert.Equal(t, timeEntry{time: 20, offset: 4}, last, "truncate doesn't drop later entries")
+
+	// a torn entry is dropped on open
+	_, err = ti.file.Write([]byte{1, 2, 3})
+	assert.NoError(t, err, "error writing partial entry")
+	assert.NoError(t, ti.Close())
+	f, err = os.OpenFile(f.Name(), os.O_RDWR|os.O_APPEND, 0644)
+	assert.NoError(t, err, "error opening time index")
+	ti, err = newTimeIndex(f, 0)
+	assert.NoError(t, err, "error reopening time index")
+	assert.Equal(t, []timeEntry{{10, 0}, {20, 4}}, ti.entries, "entries are not read back")
+	assert.NoError(t, ti.Close())
+}
+
+func TestOffsetForTime(t *testing.T) {
+	dir, err := os.MkdirTemp("", "offset_for_time_test")
+	assert.NoError(t, err, "error creating dir")
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 4
+	c.Segment.TimeIndexInterval = 2
+	l, err := newLog(dir, c)
+	assert.NoError(t, err, "error creating log")
+	var times []int64
+	for i := 0; i < 10; i++ {
+		off, err := l.Append(&api.Record{Value: []byte("hello world")})
+		assert.NoError(t, err, "error appending record")
+		rec, err := l.Read(off)
+		assert.NoError(t, err, "error reading record")
+		assert.True(t, i == 0 || rec.AppendTime >= times[i-1], "append times go backwards")
+		times = append(times, rec.AppendTime)
+		time.Sleep(time.Microsecond)
+	}
+	// the first offset appended at or after each record's time
+	check := func(l *Log) {
+		for i, ts := range times {
+			want := uint64(i)
+			for want > 0 && times[want-1] >= ts {
+				want--
+			}
+			off, err := l.OffsetForTime(time.Unix(0, ts))
+			assert.NoError(t, err, "error looking up offset for time")
+			assert.Equal(t, want, off, "offset for time of record %d", i)
+		}
+		off, err := l.OffsetForTime(time.Unix(0, times[len(times)-1]+1))
+		assert.NoError(t, err, "error looking up offset for time")
+		assert.Equal(t, uint64(len(times)), off, "time after the last record should give the next offset")
+		off, err = l.OffsetForTime(time.Unix(0, 0))
+		assert.NoError(t, err, "error looking up offset for time")
+		assert.Equal(t, uint64(0), off, "time before the first record should give the first offset")
+	}
+	check(l)
+	assert.NoError(t, l.Close())
+
+	// the time index of a segment is rebuilt when it is missing, the closed segment is opened for it right away
+	assert.NoError(t, os.Remove(l.segments[0].timeIndex.Name()))
+	l, err = newLog(dir, c)
+	assert.NoError(t, err, "error reopening log")
+	assert.NotNil(t, l.segments[0].timeIndex, "closed segment missing its time index isn't opened")
+	assert.Equal(t, []timeEntry{{times[0], 0}, {times[2], 2}}, l.segments[0].timeIndex.entries, "time index is not rebuilt")
+	check(l)
+	off, err := l.Append(&api.Record{Value: []byte("hello world")})
+	assert.NoError(t, err, "error appending record")
+	rec, err := l.Read(off)
+	assert.NoError(t, err, "error reading record")
+	assert.GreaterOrEqual(t, rec.AppendTime, times[len(times)-1], "append time goes backwards after reopening")
+	assert.NoError(t, l.Close())
+}
@@ -0,0 +1,136 @@
+package log
+
+// TruncateAfter
+// removes every record with an offset higher than offset, shrinking the segment holding it in place and
+// removing the segments after it, so the next append gets offset+1. ErrHeld is returned without removing
+// anything if a hold covers any of the records. The manifest records the truncation before any file is
+// touched, from then on it is finished when the log is set up after a crash.
+func (l *Log) TruncateAfter(offset uint64) error {
+	l.maintMu.Lock()
+	defer l.maintMu.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	next := l.activeSegment.nextOffset
+	if offset+1 >= next {
+		return nil
+	}
+	for _, h := range l.holds {
+		if h.To > offset && h.From < next {
+			return ErrHeld
+		}
+	}
+	m := l.manifest()
+	m.TruncateAfter = &offset
+	if err := writeManifest(l.Dir, m); err != nil {
+		return err
+	}
+	if err := l.truncateSegments(offset); err != nil {
+		return err
+	}
+	l.unsynced.Store(0)
+	return l.writeManifest()
+}
+
+// truncateSegments
+// removes the records after offset from the open segments, the segment left holding offset becomes the active one.
+// If no segment is left a new one starts at offset+1.
+func (l *Log) truncateSegments(offset uint64) error {
+	var kept, removed []*segment
+	for _, seg := range l.segments {
+		if seg.baseOffset <= offset {
+			kept = append(kept, seg)
+			continue
+		}
+		removed = append(removed, seg)
+	}
+	l.segments = kept
+	l.publishSegments()
+	for _, seg := range removed {
+		if err := seg.Remove(); err != nil {
+			return err
+		}
+	}
+	if len(kept) == 0 {
+		l.activeSegment = nil
+		return l.openSegment(offset + 1)
+	}
+	active := kept[len(kept)-1]
+	l.activeSegment = active
+	if err := active.unseal(); err != nil {
+		return err
+	}
+	if err := active.truncateAfter(offset); err != nil {
+		return err
+	}
+	// the next append gets offset+1 even if the records before it were compacted away and the segment ends short of it
+	if active.nextOffset < offset+1 {
+		return l.openSegment(offset + 1)
+	}
+	return l.upgradeActive()
+}
+
+// truncateAfter
+// removes the records after offset from the segment and syncs the store. If offset was compacted away
+// the segment ends at the record before it.
+func (s *segment) truncateAfter(offset uint64) error {
+	if offset+1 >= s.nextOffset {
+		return nil
+	}
+	s.truncMu.Lock()
+	defer s.truncMu.Unlock()
+	rel := offset + 1 - s.baseOffset
+	entry, err := s.index.Search(uint32(rel))
+	if err != nil {
+		return err
+	}
+	_, pos, err := s.index.Read(entry)
+	if err != nil {
+		return err
+	}
+	if err = s.store.truncate(pos); err != nil {
+		return err
+	}
+	if err = s.store.Sync(); err != nil {
+		return err
+	}
+	s.index.truncate(uint64(entry))
+	if err = s.timeIndex.truncate(uint32(rel)); err != nil {
+		return err
+	}
+	s.nextOffset, s.maxTime = s.baseOffset, 0
+	if off, _, err := s.index.Read(-1); err == nil {
+		s.nextOffset = s.baseOffset + uint64(off) + 1
+		r, err := s.Read(s.nextOffset - 1)
+		if err != nil {
+			return err
+		}
+		s.maxTime = r.AppendTime
+	}
+	s.expiry, s.expiryKnown = 0, s.nextOffset == s.baseOffset
+	s.publish()
+	return nil
+}
+
+// finishTruncate
+// removes the files of the segments after the offset of the truncation recorded in the manifest, and drops them
+// from it. The segment holding the offset is truncated once it is opened. Redoing it is safe.
+func finishTruncate(dir string, m *Manifest) error {
+	if m == nil || m.TruncateAfter == nil {
+		return nil
+	}
+	var segments []ManifestSegment
+	for _, ms := range m.Segments {
+		if ms.BaseOffset <= *m.TruncateAfter {
+			if ms.NextOffset > *m.TruncateAfter+1 {
+				ms.NextOffset, ms.State = *m.TruncateAfter+1, SegmentActive
+			}
+			segments = append(segments, ms)
+			continue
+		}
+		if err := removeSegmentFiles(dir, ms.BaseOffset); err != nil {
+			return err
+		}
+	}
+	m.Segments = segments
+	return syncDir(dir)
+}
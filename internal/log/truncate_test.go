@@ -0,0 +1,119 @@
+package log
+
+import (
+	api "github.com/adityavit/dslog/api/v1"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+	"time"
+)
+
+func checkTruncatedAfter(t *testing.T, l *Log, offset uint64) {
+	t.Helper()
+	hOffset, err := l.HighestOffset()
+	assert.NoError(t, err)
+	assert.Equal(t, offset, hOffset, "unexpected highest offset")
+	_, err = l.Read(offset + 1)
+	assert.Error(t, err, "truncated record is read")
+	r, err := l.Read(offset)
+	assert.NoError(t, err, "error reading record")
+	assert.Equal(t, offset, r.Offset, "unexpected record read")
+	m, err := ReadManifest(l.Dir)
+	assert.NoError(t, err, "error reading manifest")
+	assert.Nil(t, m.TruncateAfter, "truncation is left in the manifest")
+	assert.Equal(t, offset+1, m.Segments[len(m.Segments)-1].NextOffset, "manifest isn't truncated")
+}
+
+func TestTruncateAfter(t *testing.T) {
+	l := newRetentionLog(t, Config{})
+	assert.NoError(t, l.TruncateAfter(10), "error truncating after the end")
+	assert.NoError(t, l.TruncateAfter(2), "error truncating")
+	checkTruncatedAfter(t, l, 2)
+	assert.Len(t, l.segments, 2, "later segments are kept")
+	off, err := l.Append(&api.Record{Value: []byte("hello world")})
+	assert.NoError(t, err, "error appending record")
+	assert.Equal(t, uint64(3), off, "offset after the truncation isn't reused")
+	checkTruncatedAfter(t, l, 3)
+
+	assert.NoError(t, l.Hold("legal", 3, 3), "error placing hold")
+	assert.Equal(t, ErrHeld, l.TruncateAfter(2), "held record is truncated")
+	assert.NoError(t, l.TruncateAfter(3), "error truncating after held record")
+	assert.NoError(t, l.Release("legal"), "error releasing hold")
+
+	assert.NoError(t, l.Close(), "error closing log")
+	l, err = newLog(l.Dir, l.Config)
+	assert.NoError(t, err, "error reopening log")
+	defer l.Close()
+	assert.Empty(t, l.Recovered(), "truncated segment is repaired")
+	checkTruncatedAfter(t, l, 3)
+}
+
+func TestTruncateAfterCrash(t *testing.T) {
+	l := newRetentionLog(t, Config{})
+	assert.NoError(t, l.Close(), "error closing log")
+	// crashed after the truncation was recorded in the manifest
+	m, err := ReadManifest(l.Dir)
+	assert.NoError(t, err, "error reading manifest")
+	offset := uint64(2)
+	m.TruncateAfter = &offset
+	assert.NoError(t, writeManifest(l.Dir, m), "error writing manifest")
+	assert.NoError(t, removeSegmentFiles(l.Dir, 6), "error removing segment")
+
+	l, err = newLog(l.Dir, l.Config)
+	assert.NoError(t, err, "error reopening log")
+	defer l.Close()
+	assert.Empty(t, l.Recovered(), "truncated segment is repaired")
+	checkTruncatedAfter(t, l, 2)
+	assert.Len(t, l.segments, 2, "later segments are kept")
+	r, err := l.Read(2)
+	assert.NoError(t, err, "error reading record")
+	ts, err := l.OffsetForTime(time.Unix(0, r.AppendTime+1))
+	assert.NoError(t, err, "error looking up time")
+	assert.Equal(t, uint64(3), ts, "time index isn't truncated")
+}
+
+func TestTruncateAfterAll(t *testing.T) {
+	l := newRetentionLog(t, Config{})
+	assert.NoError(t, l.Truncate(1), "error truncating")
+	assert.NoError(t, l.TruncateAfter(0), "error truncating everything")
+	assert.Len(t, l.segments, 1, "segments are kept")
+	off, err := l.Append(&api.Record{Value: []byte("hello world")})
+	assert.NoError(t, err, "error appending record")
+	assert.Equal(t, uint64(1), off, "offset after the truncation isn't reused")
+}
+
+func TestTruncateAfterCompacted(t *testing.T) {
+	dir, err := os.MkdirTemp("", "truncate_test")
+	assert.NoError(t, err, "error creating dir")
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxRecords = 10
+	l, err := newLog(dir, c)
+	assert.NoError(t, err, "error creating log")
+	for _, r := range keyed("a", "a", "a", "a", "a", "a", "a", "a", "a", "a", "a") {
+		_, err := l.Append(r)
+		assert.NoError(t, err, "error appending record")
+	}
+	// only 9 is left of segment 0-9
+	assert.NoError(t, l.Compact(), "error compacting log")
+	_, err = l.Read(0)
+	assert.NoError(t, err, "error reading record")
+
+	// truncating into the compacted records keeps the offsets up to the truncation
+	assert.NoError(t, l.TruncateAfter(5), "error truncating")
+	off, err := l.Append(&api.Record{Value: []byte("hello world")})
+	assert.NoError(t, err, "error appending record")
+	assert.Equal(t, uint64(6), off, "offset after the truncation isn't used")
+	assert.NoError(t, l.Close(), "error closing log")
+
+	l, err = newLog(dir, c)
+	assert.NoError(t, err, "error reopening log")
+	defer l.Close()
+	assert.Empty(t, l.Recovered(), "truncated segments are repaired")
+	r, err := l.Read(0)
+	assert.NoError(t, err, "error reading record")
+	assert.Equal(t, uint64(6), r.Offset, "unexpected record read")
+	off, err = l.Append(&api.Record{Value: []byte("hello world")})
+	assert.NoError(t, err, "error appending record")
+	assert.Equal(t, uint64(7), off, "offset after the truncation isn't used")
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"github.com/gorilla/mux"
 	"net/http"
 )
@@ -79,6 +80,10 @@ func (s *Server) handleConsume(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 	record, err := s.Log.Read(cReq.Offset)
+	if errors.Is(err, ErrOffsetNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -3,13 +3,24 @@ package server
 import (
 	"errors"
 	"sync"
+	"time"
 )
 
 var ErrOffsetNotFound = errors.New("offset not found")
 
 type Record struct {
-	Value  []byte `json:"value"`
-	Offset uint64 `json:"offset"`
+	Value      []byte   `json:"value"`
+	Offset     uint64   `json:"offset"`
+	Key        []byte   `json:"key,omitempty"`
+	Timestamp  int64    `json:"timestamp,omitempty"`   // unix nanoseconds set by the producer
+	AppendTime int64    `json:"append_time,omitempty"` // unix nanoseconds set by the log
+	Headers    []Header `json:"headers,omitempty"`
+	Tombstone  bool     `json:"tombstone,omitempty"` // the key is deleted, a tombstone has no value
+}
+
+type Header struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
 }
 
 type Log struct {
@@ -25,6 +36,7 @@ func (l *Log) Append(record Record) (uint64, error) {
 	l.m.Lock()
 	defer l.m.Unlock()
 	record.Offset = uint64(len(l.records))
+	record.AppendTime = time.Now().UnixNano()
 	l.records = append(l.records, record)
 	return record.Offset, nil
 }